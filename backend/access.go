@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// PortAccessConfig assigns ports to owners. Ports with owners may only be
+// power-controlled by those owners (and admin tokens); other ports by any power token.
+type PortAccessConfig struct {
+	Owners []string `toml:"owners"` // Token names or roles
+	PortSet
+}
+
+// portOwners maps port IDs to their owners according to the access config
+func portOwners(aggregated *USBTopology) map[string][]string {
+	owners := make(map[string][]string)
+	for _, entry := range config.Access {
+		// Listed port IDs are owned whether or not they are connected right now
+		ports := append([]string(nil), entry.PortIDs...)
+		if entry.Hub != "" {
+			set := entry.PortSet
+			set.PortIDs = nil
+			// The hub may just not be connected right now
+			if hubPorts, err := resolvePortSet(aggregated, set); err == nil {
+				ports = append(ports, hubPorts...)
+			}
+		}
+		for _, portID := range ports {
+			owners[portID] = append(owners[portID], entry.Owners...)
+		}
+	}
+	return owners
+}
+
+// tokenOwns reports whether a token is one of the owners, by name or role
+func tokenOwns(token APIToken, owners []string) bool {
+	for _, owner := range owners {
+		if owner == token.Name {
+			return true
+		}
+		for _, role := range token.Roles {
+			if owner == role {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// portAccess decides which ports a request may power-control
+type portAccess struct {
+	token  APIToken
+	authed bool
+	owners map[string][]string // nil until the topology has been scanned
+}
+
+// requestAccess returns the port access of a request
+func requestAccess(r *http.Request) portAccess {
+	token, authed := requestToken(r)
+	return newPortAccess(token, authed)
+}
+
+// newPortAccess returns the port access of a token against the current topology
+func newPortAccess(token APIToken, authed bool) portAccess {
+	access := portAccess{token: token, authed: authed}
+	if _, aggregated := monitor.snapshot(); aggregated != nil {
+		access.owners = portOwners(aggregated)
+	}
+	return access
+}
+
+// tokenAccess returns the port access of a configured token by name, for commands
+// that don't come in through the API
+func tokenAccess(name string) (portAccess, bool) {
+	for _, t := range apiTokens {
+		if t.Name == name {
+			return newPortAccess(t, true), true
+		}
+	}
+	return portAccess{}, false
+}
+
+// controlsAll reports whether the request may switch any port regardless of ownership
+func (a portAccess) controlsAll() bool {
+	switch {
+	case !authEnabled():
+		// Authentication is off, so is access control
+		return true
+	case !a.authed || a.token.Scope == ScopeRead:
+		return false
+	default:
+		return a.token.Scope == ScopeAdmin || len(config.Access) == 0
+	}
+}
+
+// canControl reports whether the request may switch a port
+func (a portAccess) canControl(portID string) bool {
+	switch {
+	case a.controlsAll():
+		return true
+	case !a.authed || a.token.Scope == ScopeRead:
+		return false
+	case a.owners == nil:
+		// Ownership is unknown before the first scan, so only admins may switch ports
+		return false
+	}
+	owners, owned := a.owners[portID]
+	return !owned || tokenOwns(a.token, owners)
+}
+
+// checkPortAccess responds with 403 and returns false if the request may not
+// switch one of the ports
+func checkPortAccess(w http.ResponseWriter, r *http.Request, portIDs ...string) bool {
+	access := requestAccess(r)
+	for _, portID := range portIDs {
+		if !access.canControl(portID) {
+			log.Printf("Warning: Rejected %s %s from %s: %s may not control port %s",
+				r.Method, r.URL.Path, r.RemoteAddr, requestSource(r), portID)
+			entry := requestAudit(r, "access")
+			entry.PortID, entry.Result, entry.Details = portID, AuditDenied, r.Method+" "+r.URL.Path
+			recordAudit(entry)
+			http.Error(w, fmt.Sprintf("Not allowed to control port %s", portID), http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+// annotatePortAccess marks which ports of a topology the request may control and who owns them
+func annotatePortAccess(topology *USBTopology, r *http.Request) {
+	access := requestAccess(r)
+	walkPorts(topology, func(bus int, path string, port *USBPort) {
+		portID := sysfsName(bus, path)
+		canControl := access.canControl(portID)
+		port.CanControl = &canControl
+		port.Owners = access.owners[portID]
+	})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// PortActivity summarizes recent attach/detach activity on a port
+type PortActivity struct {
+	AttachedSince      *time.Time `json:"attachedSince,omitempty"` // When the current device was attached, if known
+	UptimeSeconds      int64      `json:"uptimeSeconds,omitempty"` // Seconds since AttachedSince
+	ReconnectsLastHour int        `json:"reconnectsLastHour"`      // Attach events in the last hour
+	ReconnectsLastDay  int        `json:"reconnectsLastDay"`       // Attach events in the last 24 hours
+	LastDetach         *time.Time `json:"lastDetach,omitempty"`
+	Flapping           bool       `json:"flapping,omitempty"` // Reconnected at least flap_threshold times in the last hour
+}
+
+const (
+	activityWindow       = 24 * time.Hour
+	defaultFlapThreshold = 3
+)
+
+// portActivityState is what the tracker remembers about a port
+type portActivityState struct {
+	attachedSince time.Time
+	lastDetach    time.Time
+	attaches      []time.Time // Attach times within the activity window, oldest first
+}
+
+// portActivityTracker follows attach/detach events to derive uptime and reconnect counts
+type portActivityTracker struct {
+	mu    sync.Mutex
+	ports map[string]*portActivityState
+}
+
+var portActivity = &portActivityTracker{ports: make(map[string]*portActivityState)}
+
+// startActivityTracking seeds the tracker from history and follows new events
+func startActivityTracking() {
+	if history != nil {
+		for _, event := range history.recentAttachDetach(activityWindow) {
+			portActivity.handle(event)
+		}
+	}
+	subscribeEvents(portActivity.handle)
+}
+
+// handle updates the state of a port for attach and detach events
+func (t *portActivityTracker) handle(event PortEvent) {
+	if event.Type != EventAttach && event.Type != EventDetach {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state := t.ports[event.PortID]
+	if state == nil {
+		state = &portActivityState{}
+		t.ports[event.PortID] = state
+	}
+
+	switch event.Type {
+	case EventAttach:
+		state.attachedSince = event.Time
+		state.attaches = append(state.attaches, event.Time)
+	case EventDetach:
+		state.attachedSince = time.Time{}
+		state.lastDetach = event.Time
+	}
+
+	// Forget attaches that fell out of the window
+	cutoff := time.Now().Add(-activityWindow)
+	for len(state.attaches) > 0 && state.attaches[0].Before(cutoff) {
+		state.attaches = state.attaches[1:]
+	}
+}
+
+// activity returns the activity summary of a port, or nil if nothing is known about it
+func (t *portActivityTracker) activity(portID string, occupied bool) *PortActivity {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state := t.ports[portID]
+	if state == nil {
+		return nil
+	}
+
+	now := time.Now()
+	activity := &PortActivity{}
+	for _, at := range state.attaches {
+		if now.Sub(at) <= time.Hour {
+			activity.ReconnectsLastHour++
+		}
+		if now.Sub(at) <= activityWindow {
+			activity.ReconnectsLastDay++
+		}
+	}
+	if occupied && !state.attachedSince.IsZero() {
+		since := state.attachedSince
+		activity.AttachedSince = &since
+		activity.UptimeSeconds = int64(now.Sub(since).Seconds())
+	}
+	if !state.lastDetach.IsZero() {
+		detach := state.lastDetach
+		activity.LastDetach = &detach
+	}
+
+	threshold := config.Monitor.FlapThreshold
+	if threshold <= 0 {
+		threshold = defaultFlapThreshold
+	}
+	activity.Flapping = activity.ReconnectsLastHour >= threshold
+
+	return activity
+}
+
+// annotatePortActivity attaches uptime and reconnect counters to the ports of a topology
+func annotatePortActivity(topology *USBTopology) {
+	walkPorts(topology, func(bus int, path string, port *USBPort) {
+		port.Activity = portActivity.activity(sysfsName(bus, path), port.Device != nil)
+	})
+}
+
+// recentAttachDetach returns attach and detach events of all ports within the window,
+// plus the last attach and detach of each port before it, oldest first
+func (h *historyStore) recentAttachDetach(window time.Duration) []PortEvent {
+	now := time.Now()
+	since := now.Add(-window)
+	attachDetach := map[string]bool{EventAttach: true, EventDetach: true}
+
+	var events []PortEvent
+	for _, portID := range h.portIDs() {
+		for _, eventType := range []string{EventAttach, EventDetach} {
+			last, _ := h.query(portID, time.Unix(0, 0), since, map[string]bool{eventType: true}, 1)
+			events = append(events, last...)
+		}
+		recent, _ := h.query(portID, since, now, attachDetach, defaultMaxEventsPerPort)
+		events = append(events, recent...)
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+	return events
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"log/syslog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AuditConfig configures the audit log of power actions and changes
+type AuditConfig struct {
+	Disabled  bool   `toml:"disabled"`
+	Path      string `toml:"path"`       // JSON lines file, default "hubcontrol-audit.log"
+	Syslog    bool   `toml:"syslog"`     // Also send entries to the local syslog
+	SyslogTag string `toml:"syslog_tag"` // Default "hubcontrol"
+}
+
+const (
+	defaultAuditPath  = "hubcontrol-audit.log"
+	defaultAuditLimit = 100
+)
+
+// AuditEntry records who did what to which port, and how it went
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Actor      string    `json:"actor"`            // Token name, "anonymous", or the subsystem, e.g. "mqtt"
+	Remote     string    `json:"remote,omitempty"` // Remote address of API requests
+	Operation  string    `json:"operation"`        // e.g. "power", "lease_acquire", "schedule_update"
+	PortID     string    `json:"portId,omitempty"`
+	Location   string    `json:"location,omitempty"` // uhubctl hub location
+	Port       int       `json:"port,omitempty"`     // Port number on that hub
+	MappedPort int       `json:"mappedPort,omitempty"`
+	HubName    string    `json:"hubName,omitempty"`
+	Action     string    `json:"action,omitempty"`
+	Result     string    `json:"result"` // "ok", "denied" or "error"
+	Output     string    `json:"output,omitempty"`
+	Details    string    `json:"details,omitempty"`
+}
+
+// Audit results
+const (
+	AuditOK     = "ok"
+	AuditDenied = "denied"
+	AuditError  = "error"
+)
+
+// auditLog appends entries to the audit file and syslog
+type auditLog struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	syslog *syslog.Writer
+}
+
+var audit *auditLog
+
+// openAudit opens the audit log unless it is disabled
+func openAudit() {
+	if config.Audit.Disabled {
+		return
+	}
+	path := config.Audit.Path
+	if path == "" {
+		path = defaultAuditPath
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		log.Printf("Warning: Failed to open audit log %s: %v", path, err)
+		return
+	}
+	audit = &auditLog{path: path, file: file}
+
+	if config.Audit.Syslog {
+		tag := config.Audit.SyslogTag
+		if tag == "" {
+			tag = "hubcontrol"
+		}
+		if audit.syslog, err = syslog.New(syslog.LOG_NOTICE|syslog.LOG_AUTH, tag); err != nil {
+			log.Printf("Warning: Failed to connect to syslog: %v", err)
+		}
+	}
+	log.Printf("Writing audit log to %s", path)
+}
+
+// auditConfigLoad records the config file the server started with
+func auditConfigLoad() {
+	entry := AuditEntry{Actor: "system", Operation: "config_load", Result: AuditOK, Details: "defaults"}
+	if configPath != "" {
+		entry.Details = configPath
+	}
+	recordAudit(entry)
+}
+
+// recordAudit appends an entry to the audit log
+func recordAudit(entry AuditEntry) {
+	if audit == nil {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	if entry.PortID != "" && entry.MappedPort == 0 && entry.HubName == "" {
+		if ref, ok := monitor.portRef(entry.PortID); ok {
+			entry.MappedPort = ref.MappedPort
+			entry.HubName = ref.HubName
+		}
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Warning: Failed to encode audit entry: %v", err)
+		return
+	}
+
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+	if _, err := audit.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Warning: Failed to write audit log: %v", err)
+	}
+	if audit.syslog != nil {
+		audit.syslog.Notice(string(line))
+	}
+}
+
+// requestAudit starts an audit entry for an API request
+func requestAudit(r *http.Request, operation string) AuditEntry {
+	actor := "anonymous"
+	if token, ok := requestToken(r); ok {
+		actor = token.Name
+	}
+	return AuditEntry{
+		Actor:     actor,
+		Remote:    r.RemoteAddr,
+		Operation: operation,
+		Result:    AuditOK,
+	}
+}
+
+// auditResult returns the audit result for an error
+func auditResult(err error) string {
+	if err != nil {
+		return AuditError
+	}
+	return AuditOK
+}
+
+// getAudit returns audit entries, oldest first.
+// Query parameters: from, to (RFC 3339 or a duration ago), actor, operation,
+// port (port ID or mapped port), result, limit (the newest entries are kept).
+func getAudit(w http.ResponseWriter, r *http.Request) {
+	if audit == nil {
+		http.Error(w, "Audit log is disabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	from, err := parseHistoryTime(query.Get("from"), time.Unix(0, 0))
+	if err != nil {
+		http.Error(w, "Invalid from: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseHistoryTime(query.Get("to"), time.Now())
+	if err != nil {
+		http.Error(w, "Invalid to: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := defaultAuditLimit
+	if l := query.Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	actor, operation, port, result := query.Get("actor"), query.Get("operation"), query.Get("port"), query.Get("result")
+
+	file, err := os.Open(audit.path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	entries := make([]AuditEntry, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		switch {
+		case entry.Time.Before(from) || entry.Time.After(to):
+			continue
+		case actor != "" && entry.Actor != actor:
+			continue
+		case operation != "" && entry.Operation != operation:
+			continue
+		case result != "" && entry.Result != result:
+			continue
+		case port != "" && entry.PortID != port && strconv.Itoa(entry.MappedPort) != port:
+			continue
+		}
+		entries = append(entries, entry)
+		if len(entries) > limit {
+			entries = entries[1:]
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
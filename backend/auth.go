@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// AuthConfig configures API authentication and cross-origin access
+type AuthConfig struct {
+	Tokens            []APIToken `toml:"tokens"`
+	TokenFile         string     `toml:"token_file"`         // Further tokens, one "<name> <scope> <token> [role,...]" per line
+	AnonymousTopology bool       `toml:"anonymous_topology"` // Allow GET /api/topology and its export without a token
+	CORSOrigins       []string   `toml:"cors_origins"`       // Origins allowed to call the API from a browser, "*" for any
+}
+
+// APIToken is a bearer token and what it may do
+type APIToken struct {
+	Name  string   `toml:"name"`
+	Scope string   `toml:"scope"` // "read", "power" or "admin"
+	Token string   `toml:"token"`
+	Roles []string `toml:"roles"` // Roles for port ownership, see PortAccessConfig
+}
+
+// Token scopes: read allows GET requests, power also allows changes such as power
+// control of ports the token may access, admin allows control of all ports
+const (
+	ScopeRead  = "read"
+	ScopePower = "power"
+	ScopeAdmin = "admin"
+)
+
+type authContextKey struct{}
+
+// apiTokens holds the tokens from the config and the token file
+var apiTokens []APIToken
+
+// loadAuth collects the configured tokens
+func loadAuth() {
+	for _, t := range config.Auth.Tokens {
+		addAPIToken(t, "config")
+	}
+
+	if path := config.Auth.TokenFile; path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			log.Printf("Warning: Failed to read token file: %v", err)
+		} else {
+			scanner := bufio.NewScanner(file)
+			for line := 1; scanner.Scan(); line++ {
+				text := strings.TrimSpace(scanner.Text())
+				if text == "" || strings.HasPrefix(text, "#") {
+					continue
+				}
+				fields := strings.Fields(text)
+				if len(fields) < 3 {
+					log.Printf("Warning: %s:%d: expected \"<name> <scope> <token> [roles]\"", path, line)
+					continue
+				}
+				t := APIToken{Name: fields[0], Scope: fields[1], Token: fields[2]}
+				if len(fields) > 3 {
+					t.Roles = strings.Split(fields[3], ",")
+				}
+				addAPIToken(t, fmt.Sprintf("%s:%d", path, line))
+			}
+			file.Close()
+		}
+	}
+
+	loadClientCerts()
+
+	if !authEnabled() {
+		log.Println("Warning: No API tokens configured, anyone who can reach the server can control port power")
+		return
+	}
+	if len(apiTokens) > 0 {
+		log.Printf("API authentication enabled with %d token(s)", len(apiTokens))
+	}
+}
+
+// authEnabled reports whether requests must authenticate, with a token or client certificate
+func authEnabled() bool {
+	return len(apiTokens) > 0 || len(clientCerts) > 0
+}
+
+// addAPIToken validates a token and adds it
+func addAPIToken(t APIToken, origin string) {
+	switch {
+	case t.Token == "":
+		log.Printf("Warning: Token %q from %s is empty, skipping", t.Name, origin)
+	case t.Scope != ScopeRead && t.Scope != ScopePower && t.Scope != ScopeAdmin:
+		log.Printf("Warning: Token %q from %s has unknown scope %q, skipping", t.Name, origin, t.Scope)
+	default:
+		if t.Name == "" {
+			t.Name = fmt.Sprintf("token-%d", len(apiTokens)+1)
+		}
+		apiTokens = append(apiTokens, t)
+	}
+}
+
+// findAPIToken returns the token matching a presented value. All tokens are
+// compared in constant time so the time taken doesn't reveal anything.
+func findAPIToken(presented string) (APIToken, bool) {
+	sum := sha256.Sum256([]byte(presented))
+	var found APIToken
+	ok := false
+	for _, t := range apiTokens {
+		tokenSum := sha256.Sum256([]byte(t.Token))
+		if subtle.ConstantTimeCompare(sum[:], tokenSum[:]) == 1 {
+			found, ok = t, true
+		}
+	}
+	return found, ok
+}
+
+// requestToken returns the token a request was authenticated with, if any
+func requestToken(r *http.Request) (APIToken, bool) {
+	t, ok := r.Context().Value(authContextKey{}).(APIToken)
+	return t, ok
+}
+
+// requestSource describes who made a request, for the source of the events it causes
+func requestSource(r *http.Request) string {
+	if t, ok := requestToken(r); ok {
+		return "api:" + t.Name
+	}
+	return "api"
+}
+
+// authMiddleware requires a bearer token or a known client certificate with a
+// sufficient scope for the API and metrics when authentication is configured.
+// The frontend's static files stay public.
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authEnabled() || r.Method == "OPTIONS" ||
+			!(strings.HasPrefix(r.URL.Path, "/api/") || r.URL.Path == "/metrics") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var token APIToken
+		if header := r.Header.Get("Authorization"); header != "" {
+			presented, found := strings.CutPrefix(header, "Bearer ")
+			if !found {
+				authFailed(w, r, http.StatusUnauthorized, "not a bearer token")
+				return
+			}
+			var ok bool
+			if token, ok = findAPIToken(strings.TrimSpace(presented)); !ok {
+				authFailed(w, r, http.StatusUnauthorized, "invalid token")
+				return
+			}
+		} else if cert, ok := clientCertToken(r); ok {
+			token = cert
+		} else if config.Server.SocketTrusted && isLocalRequest(r) {
+			token = APIToken{Name: "local", Scope: ScopeAdmin}
+		} else {
+			if config.Auth.AnonymousTopology && r.Method == "GET" && (r.URL.Path == "/api/topology" || r.URL.Path == "/api/topology/export") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			authFailed(w, r, http.StatusUnauthorized, "missing token")
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), authContextKey{}, token))
+		if r.Method != "GET" && r.Method != "HEAD" && token.Scope == ScopeRead {
+			authFailed(w, r, http.StatusForbidden, fmt.Sprintf("token %q has %s scope", token.Name, token.Scope))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authFailed logs a rejected request and responds with the given status
+func authFailed(w http.ResponseWriter, r *http.Request, status int, reason string) {
+	log.Printf("Warning: Rejected %s %s from %s: %s", r.Method, r.URL.Path, r.RemoteAddr, reason)
+	if r.Method != "GET" && r.Method != "HEAD" {
+		// Changes that were attempted without a valid token
+		entry := requestAudit(r, "auth")
+		entry.Result, entry.Details = AuditDenied, r.Method+" "+r.URL.Path+": "+reason
+		recordAudit(entry)
+	}
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="hubcontrol"`)
+	}
+	http.Error(w, http.StatusText(status), status)
+}
+
+// corsMiddleware allows browsers on the configured origins to call the API
+func corsMiddleware(next http.Handler) http.Handler {
+	allowed := make(map[string]bool)
+	for _, origin := range config.Auth.CORSOrigins {
+		allowed[strings.TrimSuffix(origin, "/")] = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin != "" && (allowed["*"] || allowed[origin]) {
+			if allowed["*"] {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Add("Vary", "Origin")
+			}
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		}
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
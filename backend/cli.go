@@ -0,0 +1,700 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const cliUsage = `Usage: hubctl [flags] <command> [arguments]
+
+Commands:
+  list                          List all hub ports and what is attached to them
+  tree                          Show the USB device tree
+  show <port>                   Show the details of a port
+  power on|off|cycle <port>...  Switch port power
+  watch [port...]               Follow attach, detach, power and error events
+  find <vid:pid|serial>         Find the ports a device is attached to
+  snapshot [note]               Store a snapshot of the topology
+  snapshots                     List the stored snapshots
+  diff [from [to]]              Compare snapshots given by ID, time or "now"
+                                (default: the newest snapshot and now)
+  tui                           Show the hub grid live and switch ports with the keyboard
+
+Ports are given as hub name and mapped port ("Test Hub:7"), hub name and
+port key ("Test Hub:1.2"), just the mapped port or port key if no other hub
+has it ("7"), or the port's location ("1-3.1.2").
+
+Without -server or -socket, hubctl scans the local hubs and runs uhubctl itself.
+It honors the leases and power holds in the server's state files: leased ports
+are only switched with the lease's -lease ID, held ports not at all. Power actions
+are appended to the audit log. Port access rules and tokens do not apply, as it
+runs with the local user's permissions.
+
+Flags:
+`
+
+// cliCommands are the hubctl commands, which hubcontrol also accepts as first argument
+var cliCommands = map[string]bool{
+	"list": true, "tree": true, "show": true, "power": true, "watch": true, "find": true,
+	"snapshot": true, "snapshots": true, "diff": true, "tui": true,
+}
+
+// cliArgs returns the hubctl arguments if the program was run as hubctl or
+// given a hubctl command
+func cliArgs(args []string) ([]string, bool) {
+	if filepath.Base(args[0]) == "hubctl" {
+		return args[1:], true
+	}
+	if len(args) > 1 && cliCommands[args[1]] {
+		return args[1:], true
+	}
+	return nil, false
+}
+
+// cli holds the state of a hubctl run
+type cli struct {
+	backend   cliBackend
+	json      bool
+	lease     string
+	types     string
+	aggregate bool
+	out       io.Writer
+}
+
+// errCLIUsage is returned for invalid command lines
+var errCLIUsage = errors.New("usage")
+
+// runCLI runs hubctl and returns the exit code
+func runCLI(args []string) int {
+	fs := flag.NewFlagSet("hubctl", flag.ContinueOnError)
+	server := fs.String("server", os.Getenv("HUBCONTROL_SERVER"), "URL of a hubcontrol server, e.g. http://lab-pi:8080 (env HUBCONTROL_SERVER)")
+	socket := fs.String("socket", os.Getenv("HUBCONTROL_SOCKET"), "Unix socket of a hubcontrol server (env HUBCONTROL_SOCKET)")
+	token := fs.String("token", os.Getenv("HUBCONTROL_TOKEN"), "API token for the server (env HUBCONTROL_TOKEN)")
+	configFile := fs.String("config", "", "config file for local use (default: search like the server)")
+	verbose := fs.Bool("v", false, "log what happens, for local use")
+	c := &cli{out: os.Stdout}
+	fs.BoolVar(&c.json, "json", false, "print JSON instead of tables")
+	fs.StringVar(&c.lease, "lease", "", "power, tui: ID of a lease on the ports")
+	fs.StringVar(&c.types, "type", "", "watch: comma-separated event types, e.g. attach,detach")
+	fs.BoolVar(&c.aggregate, "aggregate", false, "tree: show combined hubs as one device, as in the UI")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), cliUsage)
+		fs.PrintDefaults()
+	}
+
+	positional, err := parseCLIArgs(fs, args)
+	if err != nil {
+		return 2
+	}
+	if len(positional) == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	log.SetFlags(0)
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+	if *server != "" || *socket != "" {
+		c.backend = newRemoteBackend(*server, *socket, *token)
+	} else {
+		flags.config = *configFile
+		loadConfig()
+		openAudit()
+		loadLeases()
+		startHolds()
+		subscribeEvents(portPower.handle)
+		c.backend = localBackend{}
+	}
+
+	command, rest := positional[0], positional[1:]
+	switch command {
+	case "list":
+		err = c.list(rest)
+	case "tree":
+		err = c.tree(rest)
+	case "show":
+		err = c.show(rest)
+	case "power":
+		err = c.power(rest)
+	case "watch":
+		err = c.watch(rest)
+	case "find":
+		err = c.find(rest)
+	case "snapshot":
+		err = c.snapshot(rest)
+	case "snapshots":
+		err = c.snapshots(rest)
+	case "diff":
+		err = c.diff(rest)
+	case "tui":
+		err = c.runTUI(rest)
+	default:
+		fmt.Fprintf(os.Stderr, "hubctl: unknown command %q\n", command)
+		err = errCLIUsage
+	}
+
+	switch {
+	case errors.Is(err, errCLIUsage):
+		fs.Usage()
+		return 2
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "hubctl: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// parseCLIArgs parses flags anywhere on the command line and returns the other arguments
+func parseCLIArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// cliDevice is the summary of a device in hubctl output
+type cliDevice struct {
+	VendorID  string `json:"vendorId"`
+	ProductID string `json:"productId"`
+	Name      string `json:"name"`
+	Serial    string `json:"serial,omitempty"`
+	Class     string `json:"class,omitempty"`
+	Speed     string `json:"speed,omitempty"`
+}
+
+// cliPort is a port in hubctl output
+type cliPort struct {
+	Name       string     `json:"name"` // How to address the port on the command line
+	PortID     string     `json:"portId"`
+	Hub        string     `json:"hub,omitempty"`
+	MappedPort int        `json:"mappedPort,omitempty"`
+	PortKey    string     `json:"portKey,omitempty"`
+	Device     *cliDevice `json:"device,omitempty"`
+
+	port *USBPort
+}
+
+var (
+	cliPortIDPattern  = regexp.MustCompile(`^\d+-\d+(\.\d+)*$`)
+	cliPortKeyPattern = regexp.MustCompile(`^\d+\.\d+$`)
+	cliDevicePattern  = regexp.MustCompile(`^[0-9A-Fa-f]{4}:[0-9A-Fa-f]{4}$`)
+)
+
+// parsePortSelector parses a port argument, see cliUsage
+func parsePortSelector(arg string) (PortSelector, error) {
+	if cliPortIDPattern.MatchString(arg) {
+		return PortSelector{PortID: arg}, nil
+	}
+	hub, port := "", arg
+	if i := strings.LastIndex(arg, ":"); i >= 0 {
+		hub, port = arg[:i], arg[i+1:]
+	}
+	if n, err := strconv.Atoi(port); err == nil && n > 0 {
+		return PortSelector{Hub: hub, MappedPort: n}, nil
+	}
+	if cliPortKeyPattern.MatchString(port) {
+		return PortSelector{Hub: hub, PortKey: port}, nil
+	}
+	return PortSelector{}, fmt.Errorf("invalid port %q, expected e.g. \"Hub:7\", \"Hub:1.2\" or \"1-3.1.2\"", arg)
+}
+
+// cliPortLabel returns the hub:port name of a port on an aggregated hub, or "" for other ports
+func cliPortLabel(hub string, port *USBPort) string {
+	switch {
+	case hub != "" && port.MappedPort > 0:
+		return fmt.Sprintf("%s:%d", hub, port.MappedPort)
+	case hub != "" && port.PortKey != "":
+		return hub + ":" + port.PortKey
+	}
+	return ""
+}
+
+// cliPorts lists all ports of an aggregated topology
+func cliPorts(aggregated *USBTopology) []cliPort {
+	var ports []cliPort
+	walkDevices(aggregated, func(bus int, path string, depth int, device *USBDevice) {
+		hub := ""
+		if device.Aggregated {
+			hub = hubDisplayName(device)
+		}
+		walkDevicePorts(device, bus, path, func(portPath string, port *USBPort) {
+			ports = append(ports, newCLIPort(hub, sysfsName(bus, portPath), port))
+		})
+	})
+	return ports
+}
+
+// newCLIPort describes a port of an aggregated hub (hub is its name) or of another device
+func newCLIPort(hub, portID string, port *USBPort) cliPort {
+	p := cliPort{
+		PortID:     portID,
+		Hub:        hub,
+		MappedPort: port.MappedPort,
+		PortKey:    port.PortKey,
+		port:       port,
+	}
+	p.Name = cliPortLabel(hub, port)
+	if p.Name == "" {
+		p.Name = p.PortID
+	}
+	if d := port.Device; d != nil {
+		p.Device = &cliDevice{
+			VendorID:  d.VendorID,
+			ProductID: d.ProductID,
+			Name:      d.Name,
+			Serial:    d.Serial,
+			Class:     d.Class,
+			Speed:     d.Speed,
+		}
+	}
+	return p
+}
+
+// resolvePorts resolves port arguments to ports of an aggregated topology
+func resolvePorts(aggregated *USBTopology, args []string) ([]cliPort, error) {
+	byID := make(map[string]cliPort)
+	for _, p := range cliPorts(aggregated) {
+		byID[p.PortID] = p
+	}
+
+	var ports []cliPort
+	for _, arg := range args {
+		sel, err := parsePortSelector(arg)
+		if err != nil {
+			return nil, err
+		}
+		portID, err := resolvePort(aggregated, sel)
+		if err != nil {
+			return nil, err
+		}
+		p, ok := byID[portID]
+		if !ok {
+			return nil, fmt.Errorf("port %s not found", portID)
+		}
+		ports = append(ports, p)
+	}
+	return ports, nil
+}
+
+// writeJSON prints a value as indented JSON
+func (c *cli) writeJSON(v interface{}) error {
+	enc := json.NewEncoder(c.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// writePortTable prints ports as a table
+func (c *cli) writePortTable(ports []cliPort) error {
+	if c.json {
+		if ports == nil {
+			ports = []cliPort{}
+		}
+		return c.writeJSON(ports)
+	}
+	tw := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PORT\tID\tDEVICE\tNAME\tSERIAL")
+	for _, p := range ports {
+		device, name, serial := "-", "", ""
+		if p.Device != nil {
+			device = p.Device.VendorID + ":" + p.Device.ProductID
+			name, serial = p.Device.Name, p.Device.Serial
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", p.Name, p.PortID, device, name, serial)
+	}
+	return tw.Flush()
+}
+
+// list prints all ports
+func (c *cli) list(args []string) error {
+	if len(args) > 0 {
+		return errCLIUsage
+	}
+	aggregated, err := c.backend.topology(true)
+	if err != nil {
+		return err
+	}
+	return c.writePortTable(cliPorts(aggregated))
+}
+
+// find prints the ports a device given by VID:PID or serial number is attached to
+func (c *cli) find(args []string) error {
+	if len(args) != 1 {
+		return errCLIUsage
+	}
+	query := DeviceQuery{Serial: args[0]}
+	if cliDevicePattern.MatchString(args[0]) {
+		query = DeviceQuery{VendorID: args[0][:4], ProductID: args[0][5:]}
+	}
+	matches, err := c.backend.devices(query)
+	if err != nil {
+		return err
+	}
+	if len(matches) == 0 {
+		if c.json {
+			c.writeJSON([]cliPort{})
+		}
+		return fmt.Errorf("no device matches %s", args[0])
+	}
+
+	found := make([]cliPort, 0, len(matches))
+	for _, m := range matches {
+		port := &USBPort{MappedPort: m.MappedPort, PortKey: m.PortKey, Device: m.Device}
+		found = append(found, newCLIPort(m.HubName, m.PortID, port))
+	}
+	return c.writePortTable(found)
+}
+
+// tree prints the device tree; with -json the topology as the API returns it
+func (c *cli) tree(args []string) error {
+	if len(args) > 0 {
+		return errCLIUsage
+	}
+	topology, err := c.backend.topology(c.aggregate)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.writeJSON(topology)
+	}
+	for _, b := range topology.Buses {
+		if b.Device != nil {
+			c.printTree(b.Device, b.Bus, "", "", 0)
+		}
+	}
+	return nil
+}
+
+// printTree prints a device and everything attached below it
+func (c *cli) printTree(device *USBDevice, bus int, path, label string, depth int) {
+	id := fmt.Sprintf("Bus %d", bus)
+	if path != "" {
+		id = sysfsName(bus, path)
+	}
+	line := fmt.Sprintf("%s%s  %s:%s %s", strings.Repeat("  ", depth), id, device.VendorID, device.ProductID, device.Name)
+	if label != "" {
+		line += "  [" + label + "]"
+	}
+	if device.Serial != "" {
+		line += "  serial " + device.Serial
+	}
+	fmt.Fprintln(c.out, line)
+
+	hub := ""
+	if device.Aggregated {
+		hub = hubDisplayName(device)
+	}
+	walkDevicePorts(device, bus, path, func(portPath string, port *USBPort) {
+		if port.Device != nil {
+			c.printTree(port.Device, bus, portPath, cliPortLabel(hub, port), depth+1)
+		}
+	})
+}
+
+// show prints the details of a port
+func (c *cli) show(args []string) error {
+	if len(args) != 1 {
+		return errCLIUsage
+	}
+	aggregated, err := c.backend.topology(true)
+	if err != nil {
+		return err
+	}
+	ports, err := resolvePorts(aggregated, args)
+	if err != nil {
+		return err
+	}
+	p := ports[0]
+	location, uhubctlPort, _ := uhubctlTarget(p.PortID)
+
+	if c.json {
+		return c.writeJSON(struct {
+			cliPort
+			UhubctlLocation string   `json:"uhubctlLocation"`
+			UhubctlPort     int      `json:"uhubctlPort"`
+			Port            *USBPort `json:"port"`
+		}{p, location, uhubctlPort, p.port})
+	}
+
+	tw := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	field := func(name, format string, args ...interface{}) {
+		fmt.Fprintf(tw, "%s:\t%s\n", name, fmt.Sprintf(format, args...))
+	}
+	field("Port", "%s", p.Name)
+	field("Port ID", "%s", p.PortID)
+	field("uhubctl", "-l %s -p %d", location, uhubctlPort)
+	if p.Hub != "" {
+		field("Hub", "%s", p.Hub)
+	}
+	if p.MappedPort > 0 {
+		field("Mapped port", "%d", p.MappedPort)
+	}
+	if p.PortKey != "" {
+		field("Port key", "%s", p.PortKey)
+	}
+
+	if d := p.port.Device; d != nil {
+		field("Device", "%s:%s %s", d.VendorID, d.ProductID, d.Name)
+		if d.Serial != "" {
+			field("Serial", "%s", d.Serial)
+		}
+		field("Class", "%s", d.Class)
+		field("Driver", "%s", d.Driver)
+		field("Speed", "%s", d.Speed)
+		if d.MaxPowerMA > 0 {
+			field("Max power", "%d mA", d.MaxPowerMA)
+		}
+	} else {
+		field("Device", "none")
+	}
+
+	if a := p.port.Activity; a != nil && a.AttachedSince != nil {
+		field("Attached", "%s (%s ago)", a.AttachedSince.Format(time.RFC3339), time.Duration(a.UptimeSeconds)*time.Second)
+	}
+	if a := p.port.Activity; a != nil && (a.ReconnectsLastDay > 0 || a.Flapping) {
+		field("Reconnects", "%d in the last hour, %d in the last day", a.ReconnectsLastHour, a.ReconnectsLastDay)
+	}
+	if e := p.port.Errors; e != nil {
+		field("Errors", "%d over-current, %d enumeration", e.OverCurrent, e.EnumErrors)
+	}
+	if len(p.port.Owners) > 0 {
+		field("Owners", "%s", strings.Join(p.port.Owners, ", "))
+	}
+	if l := p.port.Lease; l != nil {
+		field("Leased", "by %s until %s", l.Owner, l.Expires.Format(time.RFC3339))
+	}
+	if p.port.CanControl != nil && !*p.port.CanControl {
+		field("Control", "not allowed")
+	}
+	return tw.Flush()
+}
+
+// power switches one or more ports
+func (c *cli) power(args []string) error {
+	if len(args) < 2 {
+		return errCLIUsage
+	}
+	action := args[0]
+	if _, ok := powerEventTypes[action]; !ok {
+		return fmt.Errorf("invalid action %q, expected on, off or cycle", action)
+	}
+	aggregated, err := c.backend.topology(true)
+	if err != nil {
+		return err
+	}
+	ports, err := resolvePorts(aggregated, args[1:])
+	if err != nil {
+		return err
+	}
+
+	type result struct {
+		Port    string `json:"port"`
+		PortID  string `json:"portId"`
+		Action  string `json:"action"`
+		Success bool   `json:"success"`
+		Message string `json:"message"`
+	}
+	var results []result
+	failed := 0
+	for _, p := range ports {
+		output, err := c.backend.power(p.PortID, action, c.lease)
+		r := result{Port: p.Name, PortID: p.PortID, Action: action, Success: err == nil, Message: strings.TrimSpace(output)}
+		if err != nil {
+			r.Message = err.Error()
+			failed++
+		}
+		results = append(results, r)
+		if !c.json {
+			if err != nil {
+				fmt.Fprintf(c.out, "%s (%s): %s failed: %v\n", p.Name, p.PortID, action, err)
+			} else {
+				fmt.Fprintf(c.out, "%s (%s): %s\n", p.Name, p.PortID, action)
+			}
+		}
+	}
+
+	if c.json {
+		if err := c.writeJSON(results); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d port(s) failed", failed, len(ports))
+	}
+	return nil
+}
+
+// watch prints events as they happen, one line (or JSON object) per event
+func (c *cli) watch(args []string) error {
+	var types []string
+	if c.types != "" {
+		for _, t := range strings.Split(c.types, ",") {
+			types = append(types, strings.TrimSpace(t))
+		}
+	}
+
+	var portIDs map[string]bool
+	if len(args) > 0 {
+		aggregated, err := c.backend.topology(true)
+		if err != nil {
+			return err
+		}
+		ports, err := resolvePorts(aggregated, args)
+		if err != nil {
+			return err
+		}
+		portIDs = make(map[string]bool)
+		for _, p := range ports {
+			portIDs[p.PortID] = true
+		}
+	}
+
+	enc := json.NewEncoder(c.out)
+	return c.backend.watch(types, portIDs, func(event PortEvent) {
+		if c.json {
+			enc.Encode(event)
+			return
+		}
+		port := event.PortID
+		if label := cliPortLabel(event.HubName, &USBPort{MappedPort: event.MappedPort, PortKey: event.PortKey}); label != "" {
+			port = fmt.Sprintf("%s (%s)", label, event.PortID)
+		}
+		line := fmt.Sprintf("%s  %-16s %s", event.Time.Local().Format("15:04:05"), event.Type, port)
+		if event.VendorID != "" {
+			line += fmt.Sprintf("  %s:%s %s", event.VendorID, event.ProductID, event.DeviceName)
+		}
+		if event.Source != "" {
+			line += "  by " + event.Source
+		}
+		if event.Message != "" {
+			line += "  " + event.Message
+		}
+		fmt.Fprintln(c.out, line)
+	})
+}
+
+// snapshot stores a topology snapshot with an optional note
+func (c *cli) snapshot(args []string) error {
+	info, err := c.backend.snapshot(strings.Join(args, " "))
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.writeJSON(info)
+	}
+	fmt.Fprintf(c.out, "Snapshot %d: %d devices\n", info.ID, info.Devices)
+	return nil
+}
+
+// snapshots lists the stored topology snapshots
+func (c *cli) snapshots(args []string) error {
+	if len(args) > 0 {
+		return errCLIUsage
+	}
+	infos, err := c.backend.snapshots()
+	if err != nil {
+		return err
+	}
+	if c.json {
+		if infos == nil {
+			infos = []SnapshotInfo{}
+		}
+		return c.writeJSON(infos)
+	}
+	tw := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTIME\tTRIGGER\tDEVICES\tNOTE")
+	for _, info := range infos {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%s\n", info.ID, info.Time.Local().Format(time.RFC3339), info.Trigger, info.Devices, info.Note)
+	}
+	return tw.Flush()
+}
+
+// diff prints what changed between two snapshots
+func (c *cli) diff(args []string) error {
+	if len(args) > 2 {
+		return errCLIUsage
+	}
+	var from, to string
+	if len(args) > 0 {
+		from = args[0]
+	}
+	if len(args) > 1 {
+		to = args[1]
+	}
+	diff, err := c.backend.diff(from, to)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.writeJSON(diff)
+	}
+
+	describe := func(info SnapshotInfo) string {
+		if info.ID == 0 {
+			return "now"
+		}
+		return fmt.Sprintf("snapshot %d (%s)", info.ID, info.Time.Local().Format(time.RFC3339))
+	}
+	fmt.Fprintf(c.out, "From %s to %s\n", describe(diff.From), describe(diff.To))
+	if !diff.changed() {
+		fmt.Fprintln(c.out, "No changes")
+		return nil
+	}
+
+	port := func(portID, hub string, mappedPort int) string {
+		if label := cliPortLabel(hub, &USBPort{MappedPort: mappedPort}); label != "" {
+			return fmt.Sprintf("%s (%s)", label, portID)
+		}
+		return portID
+	}
+	device := func(d SnapshotDevice) string {
+		description := fmt.Sprintf("%s:%s %s", d.VendorID, d.ProductID, d.Name)
+		if d.Serial != "" {
+			description += " serial " + d.Serial
+		}
+		return description
+	}
+	powerState := map[bool]string{true: "on", false: "off"}
+
+	tw := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHANGE\tPORT\tDEVICE\tDETAILS")
+	for _, d := range diff.Added {
+		fmt.Fprintf(tw, "added\t%s\t%s\t%s\n", port(d.PortID, d.HubName, d.MappedPort), device(d), d.Speed)
+	}
+	for _, d := range diff.Removed {
+		fmt.Fprintf(tw, "removed\t%s\t%s\t\n", port(d.PortID, d.HubName, d.MappedPort), device(d))
+	}
+	for _, m := range diff.Moved {
+		details := "from " + port(m.FromPortID, m.FromHubName, m.FromMappedPort)
+		if m.FromSpeed != "" {
+			details += fmt.Sprintf(", %s -> %s", m.FromSpeed, m.Speed)
+		}
+		fmt.Fprintf(tw, "moved\t%s\t%s\t%s\n", port(m.PortID, m.HubName, m.MappedPort), device(m.SnapshotDevice), details)
+	}
+	for _, s := range diff.SpeedChanged {
+		fmt.Fprintf(tw, "speed\t%s\t%s\t%s -> %s\n", port(s.PortID, s.HubName, s.MappedPort), device(s.SnapshotDevice), s.FromSpeed, s.Speed)
+	}
+	for _, p := range diff.PowerChanged {
+		fmt.Fprintf(tw, "power\t%s\t\t%s -> %s\n", port(p.PortID, p.HubName, p.MappedPort), powerState[p.From], powerState[p.To])
+	}
+	return tw.Flush()
+}
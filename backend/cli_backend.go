@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// cliBackend is what hubctl talks to: the local hubs directly, or a hubcontrol server
+type cliBackend interface {
+	// topology returns the raw or aggregated USB topology
+	topology(aggregate bool) (*USBTopology, error)
+	// power switches a port and returns the uhubctl output
+	power(portID, action, lease string) (string, error)
+	// devices searches the attached devices
+	devices(query DeviceQuery) ([]DeviceMatch, error)
+	// watch calls fn for port events until the stream ends. types and portIDs
+	// filter the events if not empty.
+	watch(types []string, portIDs map[string]bool, fn func(PortEvent)) error
+	// snapshots lists the stored topology snapshots
+	snapshots() ([]SnapshotInfo, error)
+	// snapshot stores a snapshot of the current topology
+	snapshot(note string) (*SnapshotInfo, error)
+	// diff compares two snapshots given by ID, time or "now"
+	diff(from, to string) (*TopologyDiff, error)
+}
+
+// localBackend scans the topology and runs uhubctl itself, without a server
+type localBackend struct{}
+
+// topology scans the hubs. Only the state known to this process is annotated:
+// kernel errors while watching, and the power state uhubctl reported on the first
+// scan or ports were switched to since.
+func (localBackend) topology(aggregate bool) (*USBTopology, error) {
+	topology, err := scanUSBTopology()
+	if err != nil {
+		return nil, err
+	}
+	portPower.seed()
+	if aggregate {
+		topology = aggregateTopology(topology)
+	}
+	annotateKernelErrors(topology)
+	annotatePortPower(topology)
+	return topology, nil
+}
+
+// power switches a port unless it is leased to anyone but the given lease or held
+// off, as recorded in the server's state files, and records it in the audit log
+func (localBackend) power(portID, action, lease string) (string, error) {
+	location, port, ok := uhubctlTarget(portID)
+	if !ok {
+		return "", fmt.Errorf("cannot power control port %s", portID)
+	}
+	return setLeasedPortPower(location, port, action, cliSource(), lease)
+}
+
+// cliSource describes the local user running hubctl, e.g. "cli:alice"
+func cliSource() string {
+	name := os.Getenv("SUDO_USER")
+	if name == "" {
+		if u, err := user.Current(); err == nil {
+			name = u.Username
+		}
+	}
+	if name == "" {
+		return "cli"
+	}
+	return "cli:" + name
+}
+
+func (localBackend) devices(query DeviceQuery) ([]DeviceMatch, error) {
+	topology, err := scanUSBTopology()
+	if err != nil {
+		return nil, err
+	}
+	return findDevices(topology, query), nil
+}
+
+// watch runs the topology monitor and kernel log reader of the server in this
+// process and reports their events
+func (localBackend) watch(types []string, portIDs map[string]bool, fn func(PortEvent)) error {
+	wanted := make(map[string]bool)
+	for _, t := range types {
+		wanted[t] = true
+	}
+	subscribeEvents(func(event PortEvent) {
+		if (len(wanted) == 0 || wanted[event.Type]) && (len(portIDs) == 0 || portIDs[event.PortID]) {
+			fn(event)
+		}
+	})
+	startKernelLogReader()
+	startTopologyMonitor()
+	select {}
+}
+
+// snapshotStore opens the snapshots in the history database, which only works
+// while no server has it open
+func (localBackend) snapshotStore() (*snapshotStore, error) {
+	if config.History.Disabled || config.Snapshots.Disabled {
+		return nil, fmt.Errorf("topology snapshots are disabled")
+	}
+	path := config.History.Path
+	if path == "" {
+		path = defaultHistoryPath
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s (is the server running? then use -server or -socket): %w", path, err)
+	}
+	return newSnapshotStore(db)
+}
+
+func (b localBackend) snapshots() ([]SnapshotInfo, error) {
+	store, err := b.snapshotStore()
+	if err != nil {
+		return nil, err
+	}
+	defer store.db.Close()
+	return store.list()
+}
+
+func (b localBackend) snapshot(note string) (*SnapshotInfo, error) {
+	store, err := b.snapshotStore()
+	if err != nil {
+		return nil, err
+	}
+	defer store.db.Close()
+	return store.take(SnapshotManual, note)
+}
+
+func (b localBackend) diff(from, to string) (*TopologyDiff, error) {
+	store, err := b.snapshotStore()
+	if err != nil {
+		return nil, err
+	}
+	defer store.db.Close()
+	return store.diff(from, to)
+}
+
+// remoteBackend uses the API of a hubcontrol server
+type remoteBackend struct {
+	base   string // e.g. "http://lab-pi:8080"
+	token  string
+	client *http.Client
+}
+
+// newRemoteBackend returns a backend for a server URL, or for a Unix socket if given
+func newRemoteBackend(server, socket, token string) *remoteBackend {
+	b := &remoteBackend{base: strings.TrimSuffix(server, "/"), token: token, client: &http.Client{}}
+	if socket != "" {
+		b.base = "http://localhost"
+		b.client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+	} else if !strings.Contains(b.base, "://") {
+		b.base = "http://" + b.base
+	}
+	return b
+}
+
+// request performs an API request and returns the response if it succeeded
+func (b *remoteBackend) request(method, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, b.base+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if b.token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.token)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return resp, nil
+}
+
+// call performs an API request and decodes the JSON response into v
+func (b *remoteBackend) call(method, path string, body, v interface{}) error {
+	resp, err := b.request(method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (b *remoteBackend) topology(aggregate bool) (*USBTopology, error) {
+	var topology USBTopology
+	err := b.call("GET", fmt.Sprintf("/api/topology?aggregate=%t", aggregate), nil, &topology)
+	return &topology, err
+}
+
+func (b *remoteBackend) power(portID, action, lease string) (string, error) {
+	location, port, ok := uhubctlTarget(portID)
+	if !ok {
+		return "", fmt.Errorf("cannot power control port %s", portID)
+	}
+	req := PowerControlRequest{Location: location, Port: port, Action: action, Lease: lease}
+	var resp PowerControlResponse
+	if err := b.call("POST", "/api/power", req, &resp); err != nil {
+		return "", err
+	}
+	if !resp.Success {
+		return "", fmt.Errorf("%s", strings.TrimSpace(resp.Message))
+	}
+	return resp.Message, nil
+}
+
+// devices uses the device search of the server, see getDevices
+func (b *remoteBackend) devices(query DeviceQuery) ([]DeviceMatch, error) {
+	params := url.Values{}
+	for name, value := range map[string]string{
+		"vid": query.VendorID, "pid": query.ProductID, "serial": query.Serial, "name": query.Name,
+		"class": query.Class, "driver": query.Driver, "speed": query.Speed, "hub": query.Hub,
+	} {
+		if value != "" {
+			params.Set(name, value)
+		}
+	}
+	var matches []DeviceMatch
+	err := b.call("GET", "/api/devices?"+params.Encode(), nil, &matches)
+	return matches, err
+}
+
+func (b *remoteBackend) snapshots() ([]SnapshotInfo, error) {
+	var infos []SnapshotInfo
+	err := b.call("GET", "/api/topology/snapshots", nil, &infos)
+	return infos, err
+}
+
+func (b *remoteBackend) snapshot(note string) (*SnapshotInfo, error) {
+	var info SnapshotInfo
+	err := b.call("POST", "/api/topology/snapshots", SnapshotRequest{Note: note}, &info)
+	return &info, err
+}
+
+func (b *remoteBackend) diff(from, to string) (*TopologyDiff, error) {
+	query := url.Values{}
+	if from != "" {
+		query.Set("from", from)
+	}
+	if to != "" {
+		query.Set("to", to)
+	}
+	var diff TopologyDiff
+	err := b.call("GET", "/api/topology/diff?"+query.Encode(), nil, &diff)
+	return &diff, err
+}
+
+// watch follows the server's event stream
+func (b *remoteBackend) watch(types []string, portIDs map[string]bool, fn func(PortEvent)) error {
+	path := "/api/events"
+	if len(types) > 0 {
+		path += "?type=" + url.QueryEscape(strings.Join(types, ","))
+	}
+	resp, err := b.request("GET", path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var event PortEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return fmt.Errorf("invalid event: %w", err)
+		}
+		if len(portIDs) == 0 || portIDs[event.PortID] {
+			fn(event)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("event stream closed by the server")
+}
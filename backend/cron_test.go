@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"* * * foo *",
+		"@reboot",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("%q: no error", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no time zone data:", err)
+	}
+	at := func(loc *time.Location, s string) time.Time {
+		t.Helper()
+		v, err := time.ParseInLocation("2006-01-02 15:04", s, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	// 2026-01-01 is a Thursday
+	tests := []struct {
+		expr  string
+		after string
+		want  []string // Consecutive runs
+		loc   *time.Location
+	}{
+		{"0 19 * * *", "2026-01-01 18:00", []string{"2026-01-01 19:00", "2026-01-02 19:00"}, time.UTC},
+		{"0 19 * * *", "2026-01-01 19:00", []string{"2026-01-02 19:00"}, time.UTC},
+		{"0 19 * * mon-fri", "2026-01-02 20:00", []string{"2026-01-05 19:00"}, time.UTC},
+		{"*/20 * * * *", "2026-01-01 10:05", []string{"2026-01-01 10:20", "2026-01-01 10:40", "2026-01-01 11:00"}, time.UTC},
+		{"5/15 * * * *", "2026-01-01 10:00", []string{"2026-01-01 10:05", "2026-01-01 10:20", "2026-01-01 10:35", "2026-01-01 10:50", "2026-01-01 11:05"}, time.UTC},
+		{"0 8-10/2 * * *", "2026-01-01 07:00", []string{"2026-01-01 08:00", "2026-01-01 10:00", "2026-01-02 08:00"}, time.UTC},
+		{"0 0 * * 7", "2026-01-01 00:00", []string{"2026-01-04 00:00"}, time.UTC},
+		{"0 0 * * sun", "2026-01-01 00:00", []string{"2026-01-04 00:00"}, time.UTC},
+		{"@weekly", "2026-01-01 00:00", []string{"2026-01-04 00:00"}, time.UTC},
+		{"@monthly", "2026-01-15 00:00", []string{"2026-02-01 00:00", "2026-03-01 00:00"}, time.UTC},
+		{"0 0 1,15 jan,jul *", "2026-01-10 00:00", []string{"2026-01-15 00:00", "2026-07-01 00:00"}, time.UTC},
+		{"0 12 31 * *", "2026-01-31 13:00", []string{"2026-03-31 12:00", "2026-05-31 12:00"}, time.UTC},
+		{"0 0 29 2 *", "2026-01-01 00:00", []string{"2028-02-29 00:00"}, time.UTC},
+		{"59 23 31 12 *", "2026-12-31 23:59", []string{"2027-12-31 23:59"}, time.UTC},
+
+		// Both day fields restricted: either matches. Jan 13 is a Tuesday, Jan 15 a Thursday.
+		{"0 0 13 * thu", "2026-01-12 00:00", []string{"2026-01-13 00:00", "2026-01-15 00:00"}, time.UTC},
+		{"0 0 13 * fri", "2026-01-01 00:00", []string{"2026-01-02 00:00", "2026-01-09 00:00", "2026-01-13 00:00", "2026-01-16 00:00"}, time.UTC},
+		// One day field starred: only the other one counts
+		{"0 0 * * fri", "2026-01-01 00:00", []string{"2026-01-02 00:00", "2026-01-09 00:00"}, time.UTC},
+		{"0 0 13 * *", "2026-01-01 00:00", []string{"2026-01-13 00:00", "2026-02-13 00:00"}, time.UTC},
+
+		// Spring forward: 02:30 doesn't exist on March 29th, the run is skipped
+		{"30 2 * * *", "2026-03-28 12:00", []string{"2026-03-30 02:30"}, berlin},
+		{"0 * * * *", "2026-03-29 01:30", []string{"2026-03-29 03:00"}, berlin},
+		// Fall back: 02:30 happens twice on October 25th, the run happens once
+		{"30 2 * * *", "2026-10-24 12:00", []string{"2026-10-25 02:30", "2026-10-26 02:30"}, berlin},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		next := at(tt.loc, tt.after)
+		for _, want := range tt.want {
+			next = c.next(next)
+			if w := at(tt.loc, want); !next.Equal(w) {
+				t.Errorf("%q after %s: got %s, want %s", tt.expr, tt.after, next.In(tt.loc).Format("2006-01-02 15:04 MST"), w.Format("2006-01-02 15:04 MST"))
+				break
+			}
+		}
+	}
+}
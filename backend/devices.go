@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DeviceQuery selects devices by their descriptors and the hub they are plugged
+// into. Empty fields match everything. It is shared by the device search, the
+// inventory and hubctl find.
+type DeviceQuery struct {
+	VendorID  string
+	ProductID string
+	Serial    string // Case-insensitive
+	Vendor    string // Vendor ID, or part of the manufacturer or device name
+	Name      string // Part of the device, manufacturer or product name
+	Class     string // Part of the device class
+	Driver    string
+	Speed     string // e.g. "480M" or "480"
+	Hub       string // Aggregated hub, or the hub the device is plugged into
+}
+
+// DeviceMatch is a device found by a search, with where it is plugged in
+type DeviceMatch struct {
+	PortID     string       `json:"portId"`
+	Device     *USBDevice   `json:"device"` // Without its ports
+	Path       []DeviceHop  `json:"path"`   // The hubs from the root hub to the device
+	HubName    string       `json:"hubName,omitempty"`
+	MappedPort int          `json:"mappedPort,omitempty"`
+	PortKey    string       `json:"portKey,omitempty"`
+	CanControl bool         `json:"canControl"`
+	Power      *DevicePower `json:"power,omitempty"` // How to switch the port, if allowed
+}
+
+// DeviceHop is a hub on the path to a device
+type DeviceHop struct {
+	PortID    string `json:"portId"` // e.g. "usb1" for the root hub, "1-3" for the hub on its port 3
+	Name      string `json:"name"`
+	VendorID  string `json:"vendorId"`
+	ProductID string `json:"productId"`
+	Port      int    `json:"port"` // Port of this hub towards the device
+}
+
+// DevicePower is the power control request for a device's port: POST Href with
+// Location, Port and an action
+type DevicePower struct {
+	Href     string `json:"href"`
+	Method   string `json:"method"`
+	Location string `json:"location"`
+	Port     int    `json:"port"`
+}
+
+// attachedDevice is a device below a root hub, with where it is plugged in
+type attachedDevice struct {
+	Bus     int
+	PortID  string
+	Device  *USBDevice
+	Path    []DeviceHop // The hubs from the root hub to the device
+	HubName string      // Aggregated hub, or the hub the device is plugged into
+	Ref     portRef     // Place on an aggregated hub, if any
+}
+
+// matches reports whether a device plugged into the named hub passes the query
+func (q DeviceQuery) matches(device *USBDevice, hubName string) bool {
+	name := strings.ToLower(q.Name)
+	vendor := strings.ToLower(q.Vendor)
+	switch {
+	case q.VendorID != "" && !strings.EqualFold(device.VendorID, q.VendorID):
+		return false
+	case q.ProductID != "" && !strings.EqualFold(device.ProductID, q.ProductID):
+		return false
+	case q.Serial != "" && !strings.EqualFold(device.Serial, q.Serial):
+		return false
+	case vendor != "" && !strings.EqualFold(device.VendorID, vendor) &&
+		!strings.Contains(strings.ToLower(device.Manufacturer), vendor) &&
+		!strings.Contains(strings.ToLower(device.Name), vendor):
+		return false
+	case name != "" && !strings.Contains(strings.ToLower(device.Name), name) &&
+		!strings.Contains(strings.ToLower(device.Manufacturer), name) &&
+		!strings.Contains(strings.ToLower(device.Product), name):
+		return false
+	case q.Class != "" && !strings.Contains(strings.ToLower(device.Class), strings.ToLower(q.Class)):
+		return false
+	case q.Driver != "" && !strings.EqualFold(device.Driver, q.Driver):
+		return false
+	case q.Speed != "" && strings.TrimSuffix(device.Speed, "M") != strings.TrimSuffix(q.Speed, "M"):
+		return false
+	case q.Hub != "" && !strings.EqualFold(hubName, q.Hub):
+		return false
+	}
+	return true
+}
+
+// searchDevices calls fn for every device below the root hubs of a raw topology,
+// including hubs, that matches a query, with its path through the hubs and its
+// place on the aggregated hubs
+func searchDevices(raw *USBTopology, query DeviceQuery, fn func(attachedDevice)) {
+	refs := buildPortRefs(aggregateTopology(raw))
+
+	var hubs []DeviceHop // Ancestors of the current device, by depth
+	walkDevices(raw, func(bus int, path string, depth int, device *USBDevice) {
+		hubs = append(hubs[:depth], DeviceHop{
+			PortID:    sysfsName(bus, path),
+			Name:      hubDisplayName(device),
+			VendorID:  device.VendorID,
+			ProductID: device.ProductID,
+		})
+		if path == "" {
+			return
+		}
+
+		found := attachedDevice{Bus: bus, PortID: sysfsName(bus, path), Device: device, Ref: refs[sysfsName(bus, path)]}
+		for i, segment := range strings.Split(path, ".") {
+			hop := hubs[i]
+			hop.Port, _ = strconv.Atoi(segment)
+			found.Path = append(found.Path, hop)
+		}
+		found.HubName = found.Ref.HubName
+		if found.HubName == "" {
+			found.HubName = found.Path[len(found.Path)-1].Name
+		}
+		if query.matches(device, found.HubName) {
+			fn(found)
+		}
+	})
+}
+
+// findDevices returns the devices of a raw topology that match a query
+func findDevices(raw *USBTopology, query DeviceQuery) []DeviceMatch {
+	matches := make([]DeviceMatch, 0)
+	searchDevices(raw, query, func(found attachedDevice) {
+		d := *found.Device
+		d.Ports = nil
+		matches = append(matches, DeviceMatch{
+			PortID:     found.PortID,
+			Device:     &d,
+			Path:       found.Path,
+			HubName:    found.Ref.HubName,
+			MappedPort: found.Ref.MappedPort,
+			PortKey:    found.Ref.PortKey,
+		})
+	})
+	return matches
+}
+
+// getDevices searches the attached devices by vid, pid, serial, name, class,
+// driver, speed and hub
+func getDevices(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	query := DeviceQuery{
+		VendorID:  q.Get("vid"),
+		ProductID: q.Get("pid"),
+		Serial:    q.Get("serial"),
+		Name:      q.Get("name"),
+		Class:     q.Get("class"),
+		Driver:    q.Get("driver"),
+		Speed:     q.Get("speed"),
+		Hub:       q.Get("hub"),
+	}
+
+	topology, err := parseUSBTopology()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	matches := findDevices(topology, query)
+
+	access := requestAccess(r)
+	for i := range matches {
+		m := &matches[i]
+		m.CanControl = access.canControl(m.PortID)
+		if location, port, ok := uhubctlTarget(m.PortID); ok && m.CanControl {
+			m.Power = &DevicePower{Href: "/api/power", Method: "POST", Location: location, Port: port}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(matches)
+}
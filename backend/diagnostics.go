@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// LinkIssue describes a speed or topology problem detected for a device
+type LinkIssue struct {
+	Kind     string `json:"kind"`     // "degraded_speed", "full_speed_bottleneck", "tier_depth"
+	Severity string `json:"severity"` // "info", "warning" or "error"
+	Message  string `json:"message"`
+}
+
+// The USB spec allows at most 7 tiers including the root hub, i.e. devices at most
+// 6 tiers below it and no more than 5 external hubs in a chain
+const maxTierDepth = 6
+
+// Speeds as reported by lsusb -t, in Mbit/s
+const (
+	fullSpeedMbps = 12
+	highSpeedMbps = 480
+)
+
+// seenSpeeds remembers the fastest speed each device model or unit was seen at, as
+// evidence of what it can do when it later runs slower
+var seenSpeeds = struct {
+	sync.Mutex
+	mbps map[string]float64
+}{mbps: make(map[string]float64)}
+
+// deviceSpeedKeys returns the keys a device's speed is remembered under: its model
+// and, with a serial number, the unit itself
+func deviceSpeedKeys(device *USBDevice) []string {
+	keys := []string{device.VendorID + ":" + device.ProductID}
+	if device.Serial != "" {
+		keys = append(keys, keys[0]+":"+device.Serial)
+	}
+	return keys
+}
+
+// recordSpeed remembers a device's current speed and returns the fastest it was seen at
+func recordSpeed(device *USBDevice, speed float64) float64 {
+	seenSpeeds.Lock()
+	defer seenSpeeds.Unlock()
+	fastest := speed
+	for _, key := range deviceSpeedKeys(device) {
+		if seenSpeeds.mbps[key] > fastest {
+			fastest = seenSpeeds.mbps[key]
+		}
+		seenSpeeds.mbps[key] = fastest
+	}
+	return fastest
+}
+
+// usbVersion parses a bcdUSB string like "3.20" into a comparable number
+func usbVersion(version string) float64 {
+	v, _ := strconv.ParseFloat(version, 64)
+	return v
+}
+
+// diagnoseTopology sets Depth and Issues on every device of a raw topology
+func diagnoseTopology(topology *USBTopology) {
+	for _, bus := range topology.Buses {
+		diagnoseDevice(bus.Device, 0, nil)
+	}
+}
+
+// diagnoseDevice checks a device against its capability and the hubs above it.
+// parents holds the chain of hubs from the root hub down to the device's parent.
+func diagnoseDevice(device *USBDevice, depth int, parents []*USBDevice) {
+	if device == nil {
+		return
+	}
+	device.Depth = depth
+	device.Issues = nil
+
+	speed := speedMbps(device.Speed)
+	version := usbVersion(device.USBVersion)
+
+	if depth > 0 {
+		// SuperSpeed capable device that enumerated at USB 2.0 speed or below
+		if version >= 3.0 && speed > 0 && speed < superSpeedMinimumMbs {
+			device.Issues = append(device.Issues, LinkIssue{
+				Kind:     "degraded_speed",
+				Severity: "warning",
+				Message:  fmt.Sprintf("USB %s device running at %s instead of SuperSpeed; check cable and port", device.USBVersion, device.Speed),
+			})
+		}
+
+		// Device at full speed behind a full-speed hub. bcdUSB 2.00 is also reported
+		// by full-speed-only devices, so it is only a warning if the device is known
+		// to do better: a bcdUSB above 2.00, or having been seen at high speed.
+		fastest := recordSpeed(device, speed)
+		if version >= 2.0 && speed > 0 && speed <= fullSpeedMbps {
+			for _, parent := range parents[1:] {
+				if s := speedMbps(parent.Speed); s > 0 && s <= fullSpeedMbps {
+					issue := LinkIssue{
+						Kind:     "full_speed_bottleneck",
+						Severity: "info",
+						Message:  fmt.Sprintf("running at %s behind full-speed hub %s (dev %d); it may be full-speed only", device.Speed, parent.Name, parent.Device),
+					}
+					if version > 2.0 || fastest >= highSpeedMbps {
+						issue.Severity = "warning"
+						issue.Message = fmt.Sprintf("high-speed capable, running at %s behind full-speed hub %s (dev %d)", device.Speed, parent.Name, parent.Device)
+					}
+					device.Issues = append(device.Issues, issue)
+					break
+				}
+			}
+		}
+
+		if depth > maxTierDepth {
+			device.Issues = append(device.Issues, LinkIssue{
+				Kind:     "tier_depth",
+				Severity: "error",
+				Message:  fmt.Sprintf("device is %d tiers below the root hub, the USB limit is %d", depth, maxTierDepth),
+			})
+		} else if depth == maxTierDepth && len(device.Ports) > 0 {
+			device.Issues = append(device.Issues, LinkIssue{
+				Kind:     "tier_depth",
+				Severity: "error",
+				Message:  "hub is at the last USB tier, devices attached to it will not enumerate",
+			})
+		}
+	}
+
+	chain := append(parents[:len(parents):len(parents)], device)
+	for _, port := range device.Ports {
+		diagnoseDevice(port.Device, depth+1, chain)
+	}
+}
+
+// DiagnosticIssue is a LinkIssue attributed to a device in the topology
+type DiagnosticIssue struct {
+	LinkIssue
+	Path      string `json:"path"` // Kernel device name, e.g. "1-3.2"
+	Device    int    `json:"device"`
+	VendorID  string `json:"vendorId"`
+	ProductID string `json:"productId"`
+	Name      string `json:"name"`
+	Speed     string `json:"speed"`
+}
+
+// BusDiagnostics summarizes link quality on a single USB bus
+type BusDiagnostics struct {
+	Bus      int               `json:"bus"`
+	Speed    string            `json:"speed"`
+	Devices  int               `json:"devices"`
+	Hubs     int               `json:"hubs"`
+	MaxDepth int               `json:"maxDepth"`
+	Issues   []DiagnosticIssue `json:"issues"`
+}
+
+// buildDiagnostics collects the issues of a diagnosed topology per bus
+func buildDiagnostics(topology *USBTopology) []BusDiagnostics {
+	result := make([]BusDiagnostics, 0, len(topology.Buses))
+	for _, bus := range topology.Buses {
+		diag := BusDiagnostics{
+			Bus:    bus.Bus,
+			Issues: make([]DiagnosticIssue, 0),
+		}
+		if bus.Device != nil {
+			diag.Speed = bus.Device.Speed
+		}
+
+		single := &USBTopology{Buses: []USBBus{bus}}
+		walkDevices(single, func(busNum int, path string, depth int, device *USBDevice) {
+			if depth == 0 {
+				return
+			}
+			diag.Devices++
+			if isHub(device) {
+				diag.Hubs++
+			}
+			if depth > diag.MaxDepth {
+				diag.MaxDepth = depth
+			}
+			for _, issue := range device.Issues {
+				diag.Issues = append(diag.Issues, DiagnosticIssue{
+					LinkIssue: issue,
+					Path:      sysfsName(busNum, path),
+					Device:    device.Device,
+					VendorID:  device.VendorID,
+					ProductID: device.ProductID,
+					Name:      device.Name,
+					Speed:     device.Speed,
+				})
+			}
+		})
+		result = append(result, diag)
+	}
+	return result
+}
+
+// getDiagnostics returns a per-bus summary of speed and topology issues
+func getDiagnostics(w http.ResponseWriter, r *http.Request) {
+	topology, err := parseUSBTopology()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildDiagnostics(topology))
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PortEvent is something that happened on a port: a device coming or going, a power
+// action or a kernel-reported error
+type PortEvent struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`   // See the event type constants
+	PortID     string    `json:"portId"` // Kernel name of the port, e.g. "1-3.2"
+	Bus        int       `json:"bus"`
+	Location   string    `json:"location"` // USB path of the port, e.g. "3.2"
+	PortKey    string    `json:"portKey,omitempty"`
+	MappedPort int       `json:"mappedPort,omitempty"`
+	HubName    string    `json:"hubName,omitempty"` // Name of the aggregated hub the port belongs to
+	VendorID   string    `json:"vendorId,omitempty"`
+	ProductID  string    `json:"productId,omitempty"`
+	DeviceName string    `json:"deviceName,omitempty"`
+	Serial     string    `json:"serial,omitempty"`
+	Class      string    `json:"class,omitempty"`
+	Source     string    `json:"source,omitempty"` // What triggered the event, e.g. "api" for power actions
+	Message    string    `json:"message,omitempty"`
+}
+
+// Event types
+const (
+	EventAttach      = "attach"
+	EventDetach      = "detach"
+	EventPowerOn     = "power_on"
+	EventPowerOff    = "power_off"
+	EventPowerCycle  = "power_cycle"
+	EventPowerError  = "power_error"
+	EventOverCurrent = "over_current"
+	EventEnumError   = "enum_error"
+
+	// Watchdog recovery of a missing device
+	EventRecoveryAttempt = "recovery_attempt"
+	EventRecoveryGaveUp  = "recovery_gave_up"
+	EventRecovered       = "recovered"
+
+	// Port leases
+	EventLeaseAcquired = "lease_acquired"
+	EventLeaseExtended = "lease_extended"
+	EventLeaseReleased = "lease_released"
+)
+
+var (
+	eventSubscribersMu sync.RWMutex
+	eventSubscribers   []func(PortEvent)
+)
+
+// subscribeEvents registers fn to be called for every published event.
+// Subscribers are called synchronously and must not block.
+func subscribeEvents(fn func(PortEvent)) {
+	eventSubscribersMu.Lock()
+	defer eventSubscribersMu.Unlock()
+	eventSubscribers = append(eventSubscribers, fn)
+}
+
+// publishEvent fills in the port attribution of an event and hands it to all subscribers
+func publishEvent(event PortEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.PortKey == "" && event.HubName == "" {
+		if ref, ok := monitor.portRef(event.PortID); ok {
+			event.PortKey = ref.PortKey
+			event.MappedPort = ref.MappedPort
+			event.HubName = ref.HubName
+		}
+	}
+	// Events that don't come from a scan describe the device currently on the port
+	if event.VendorID == "" && event.Type != EventDetach {
+		if raw, _ := monitor.snapshot(); raw != nil {
+			if device := findPortDevice(raw, event.PortID); device != nil {
+				event.VendorID = device.VendorID
+				event.ProductID = device.ProductID
+				event.DeviceName = device.Name
+				event.Serial = device.Serial
+				event.Class = device.Class
+			}
+		}
+	}
+
+	eventSubscribersMu.RLock()
+	subscribers := eventSubscribers
+	eventSubscribersMu.RUnlock()
+
+	for _, fn := range subscribers {
+		fn(event)
+	}
+}
+
+const eventStreamKeepalive = 30 * time.Second
+
+// eventStreams holds the channels of clients following GET /api/events
+var eventStreams = struct {
+	sync.Mutex
+	clients map[chan PortEvent]bool
+}{clients: make(map[chan PortEvent]bool)}
+
+// broadcastEvent passes an event on to the event stream clients. Clients that
+// fall behind miss events rather than holding up the publisher.
+func broadcastEvent(event PortEvent) {
+	eventStreams.Lock()
+	defer eventStreams.Unlock()
+	for ch := range eventStreams.clients {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// streamEvents sends events as they happen as server-sent events, until the
+// client disconnects or the server shuts down.
+// Query parameters: type (comma-separated event types), port (port ID).
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var types map[string]bool
+	if t := r.URL.Query().Get("type"); t != "" {
+		types = make(map[string]bool)
+		for _, name := range strings.Split(t, ",") {
+			types[strings.TrimSpace(name)] = true
+		}
+	}
+	port := r.URL.Query().Get("port")
+
+	ch := make(chan PortEvent, 64)
+	eventStreams.Lock()
+	eventStreams.clients[ch] = true
+	eventStreams.Unlock()
+	defer func() {
+		eventStreams.Lock()
+		delete(eventStreams.clients, ch)
+		eventStreams.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventStreamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case event := <-ch:
+			if (types != nil && !types[event.Type]) || (port != "" && event.PortID != port) {
+				continue
+			}
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		case <-serverStopping:
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+)
+
+// Topology export formats
+const (
+	ExportDOT     = "dot"
+	ExportMermaid = "mermaid"
+	ExportSVG     = "svg"
+)
+
+// Ports per row of hubs without a grid_layout
+const exportRowLen = 8
+
+// Port states as shown in diagrams
+const (
+	portEmpty    = "empty"
+	portOccupied = "occupied"
+	portOff      = "off"
+	portFaulted  = "faulted"
+)
+
+// portStateColors are the fill colors of port cells
+var portStateColors = map[string]string{
+	portEmpty:    "#ffffff",
+	portOccupied: "#c8e6c9",
+	portOff:      "#e0e0e0",
+	portFaulted:  "#ffcdd2",
+}
+
+// diagramPortState returns how a port is drawn: faulted if the kernel reported errors,
+// off if it was switched off, occupied if a device is attached
+func diagramPortState(port *USBPort) string {
+	switch {
+	case port.Errors != nil && (port.Errors.OverCurrent > 0 || port.Errors.EnumErrors > 0):
+		return portFaulted
+	case port.Powered != nil && !*port.Powered:
+		return portOff
+	case port.Device != nil:
+		return portOccupied
+	default:
+		return portEmpty
+	}
+}
+
+// exportTopology renders the topology as a Graphviz, Mermaid or SVG diagram
+func exportTopology(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = ExportDOT
+	}
+
+	topology, err := parseUSBTopology()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.URL.Query().Get("aggregate") == "true" {
+		topology = aggregateTopology(topology)
+	}
+	annotateTopology(topology)
+
+	var buf bytes.Buffer
+	switch format {
+	case ExportDOT:
+		w.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+		writeDOT(&buf, topology)
+	case ExportMermaid:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writeMermaid(&buf, topology)
+	case ExportSVG:
+		w.Header().Set("Content-Type", "image/svg+xml")
+		writeSVG(&buf, topology)
+	default:
+		http.Error(w, fmt.Sprintf("Unknown format %q, use dot, mermaid or svg", format), http.StatusBadRequest)
+		return
+	}
+	w.Write(buf.Bytes())
+}
+
+// diagramTitle returns the title of a device in diagrams: the bus for root hubs,
+// the hub name for aggregated hubs, otherwise the lsusb name
+func diagramTitle(bus int, path string, device *USBDevice) string {
+	switch {
+	case path == "":
+		return fmt.Sprintf("Bus %d", bus)
+	case device.Aggregated:
+		return hubDisplayName(device)
+	default:
+		return device.Name
+	}
+}
+
+// diagramDetails returns the second line of a device's label, e.g. "0403:6001, 12M, 1-3.1.2"
+func diagramDetails(bus int, path string, device *USBDevice) string {
+	var details []string
+	if path == "" {
+		details = append(details, device.Name)
+	} else {
+		details = append(details, device.VendorID+":"+device.ProductID)
+	}
+	if device.Speed != "" {
+		details = append(details, device.Speed)
+	}
+	if path != "" {
+		details = append(details, sysfsName(bus, path))
+	}
+	return strings.Join(details, ", ")
+}
+
+// hasPorts reports whether a device is drawn as a hub with port cells
+func hasPorts(device *USBDevice) bool {
+	if device.Aggregated {
+		return len(device.PhysicalPorts) > 0
+	}
+	return len(device.Ports) > 0
+}
+
+// writeDOT writes a Graphviz digraph. Hubs are tables of their ports laid out like
+// the hub, with an edge from each occupied port to its device.
+func writeDOT(b *bytes.Buffer, topology *USBTopology) {
+	b.WriteString("digraph usb {\n")
+	b.WriteString("\trankdir=LR;\n")
+	b.WriteString("\tnode [shape=box, style=\"rounded,filled\", fillcolor=\"#ffffff\", fontname=\"Helvetica\", fontsize=10];\n")
+	b.WriteString("\tedge [arrowhead=none];\n")
+
+	walkDevices(topology, func(bus int, path string, depth int, device *USBDevice) {
+		id := sysfsName(bus, path)
+		title := html.EscapeString(diagramTitle(bus, path, device))
+		details := html.EscapeString(diagramDetails(bus, path, device))
+		if !hasPorts(device) {
+			fmt.Fprintf(b, "\t%q [label=<<b>%s</b><br/>%s>];\n", id, title, details)
+			return
+		}
+
+		rows := hubGrid(device, bus, path, exportRowLen)
+		columns := 1
+		for _, row := range rows {
+			if len(row) > columns {
+				columns = len(row)
+			}
+		}
+		fmt.Fprintf(b, "\t%q [shape=plain, label=<<table border=\"0\" cellborder=\"1\" cellspacing=\"0\" cellpadding=\"4\">", id)
+		fmt.Fprintf(b, "<tr><td colspan=\"%d\" bgcolor=\"#eeeeee\"><b>%s</b><br/>%s</td></tr>", columns, title, details)
+		for _, row := range rows {
+			b.WriteString("<tr>")
+			for _, cell := range row {
+				if cell == nil {
+					b.WriteString("<td border=\"0\"></td>")
+					continue
+				}
+				state := diagramPortState(cell.Port)
+				label := html.EscapeString(cell.Label)
+				if state == portOff || state == portFaulted {
+					label += " " + state
+				}
+				fmt.Fprintf(b, "<td port=\"p%s\" bgcolor=\"%s\">%s</td>", dotPortName(cell.PortID), portStateColors[state], label)
+			}
+			for i := len(row); i < columns; i++ {
+				b.WriteString("<td border=\"0\"></td>")
+			}
+			b.WriteString("</tr>")
+		}
+		b.WriteString("</table>>];\n")
+
+		for _, row := range rows {
+			for _, cell := range row {
+				if cell != nil && cell.Port.Device != nil {
+					fmt.Fprintf(b, "\t%q:p%s -> %q;\n", id, dotPortName(cell.PortID), cell.PortID)
+				}
+			}
+		}
+	})
+	b.WriteString("}\n")
+}
+
+// dotPortName returns a Graphviz port name for a port ID, which may not contain "-" or "."
+func dotPortName(portID string) string {
+	return strings.NewReplacer("-", "_", ".", "_").Replace(portID)
+}
+
+// writeMermaid writes a Mermaid flowchart. Hubs are subgraphs holding their ports,
+// linked to the devices attached to them.
+func writeMermaid(b *bytes.Buffer, topology *USBTopology) {
+	b.WriteString("flowchart LR\n")
+	for _, state := range []string{portOccupied, portOff, portFaulted} {
+		fmt.Fprintf(b, "\tclassDef %s fill:%s\n", state, portStateColors[state])
+	}
+
+	var links []string
+	walkDevices(topology, func(bus int, path string, depth int, device *USBDevice) {
+		id := mermaidID("d", sysfsName(bus, path))
+		label := mermaidText(diagramTitle(bus, path, device)) + "<br/>" + mermaidText(diagramDetails(bus, path, device))
+		if !hasPorts(device) {
+			fmt.Fprintf(b, "\t%s[\"%s\"]\n", id, label)
+			return
+		}
+
+		fmt.Fprintf(b, "\tsubgraph %s [\"%s\"]\n", id, label)
+		for _, row := range hubGrid(device, bus, path, exportRowLen) {
+			for _, cell := range row {
+				if cell == nil {
+					continue
+				}
+				portID := mermaidID("p", cell.PortID)
+				state := diagramPortState(cell.Port)
+				label := mermaidText(cell.Label)
+				if state == portOff || state == portFaulted {
+					label += " " + state
+				}
+				fmt.Fprintf(b, "\t\t%s[\"%s\"]", portID, label)
+				if state != portEmpty {
+					b.WriteString(":::" + state)
+				}
+				b.WriteString("\n")
+				if cell.Port.Device != nil {
+					links = append(links, fmt.Sprintf("\t%s --> %s\n", portID, mermaidID("d", cell.PortID)))
+				}
+			}
+		}
+		b.WriteString("\tend\n")
+	})
+	for _, link := range links {
+		b.WriteString(link)
+	}
+}
+
+// mermaidID returns a Mermaid node ID for a device or port ID
+func mermaidID(prefix, id string) string {
+	return prefix + "_" + strings.NewReplacer("-", "_", ".", "_").Replace(id)
+}
+
+// mermaidText escapes text for a quoted Mermaid label
+func mermaidText(text string) string {
+	return strings.NewReplacer("\"", "#quot;", "<", "#lt;", ">", "#gt;").Replace(text)
+}
+
+// SVG geometry
+const (
+	svgMargin      = 16
+	svgCellWidth   = 72
+	svgCellHeight  = 52
+	svgCellGap     = 6
+	svgTitleHeight = 40
+	svgPanelGap    = 24
+	svgNameLength  = 11 // Characters of a device name that fit in a cell
+)
+
+// writeSVG draws every hub as a panel of its ports, placed like on the physical
+// hub for aggregated hubs with a grid_layout, so it can be printed as port labels
+func writeSVG(b *bytes.Buffer, topology *USBTopology) {
+	var body bytes.Buffer
+	width, y := 0, svgMargin
+	walkDevices(topology, func(bus int, path string, depth int, device *USBDevice) {
+		if !hasPorts(device) {
+			return
+		}
+		rows := hubGrid(device, bus, path, exportRowLen)
+
+		fmt.Fprintf(&body, "<g transform=\"translate(%d,%d)\">\n", svgMargin, y)
+		fmt.Fprintf(&body, "<text x=\"0\" y=\"16\" class=\"title\">%s</text>\n", html.EscapeString(diagramTitle(bus, path, device)))
+		fmt.Fprintf(&body, "<text x=\"0\" y=\"32\" class=\"details\">%s</text>\n", html.EscapeString(diagramDetails(bus, path, device)))
+		for r, row := range rows {
+			for c, cell := range row {
+				if cell == nil {
+					continue
+				}
+				x := c * (svgCellWidth + svgCellGap)
+				cy := svgTitleHeight + r*(svgCellHeight+svgCellGap)
+				writeSVGCell(&body, x, cy, cell)
+				if right := svgMargin + x + svgCellWidth + svgMargin; right > width {
+					width = right
+				}
+			}
+		}
+		body.WriteString("</g>\n")
+		y += svgTitleHeight + len(rows)*(svgCellHeight+svgCellGap) + svgPanelGap
+	})
+
+	if width < 320 {
+		width = 320
+	}
+	fmt.Fprintf(b, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\">\n", width, y, width, y)
+	b.WriteString("<style>\n")
+	b.WriteString("text { font-family: Helvetica, Arial, sans-serif; fill: #212121; }\n")
+	b.WriteString(".title { font-size: 14px; font-weight: bold; }\n")
+	b.WriteString(".details { font-size: 11px; fill: #616161; }\n")
+	b.WriteString(".port { font-size: 16px; font-weight: bold; text-anchor: middle; }\n")
+	b.WriteString(".device { font-size: 9px; text-anchor: middle; }\n")
+	b.WriteString("rect { stroke: #757575; stroke-width: 1; }\n")
+	b.WriteString("</style>\n")
+	fmt.Fprintf(b, "<rect x=\"0\" y=\"0\" width=\"%d\" height=\"%d\" fill=\"#ffffff\" stroke=\"none\"/>\n", width, y)
+	b.Write(body.Bytes())
+	b.WriteString("</svg>\n")
+}
+
+// writeSVGCell draws a port: its label, the attached device and its state
+func writeSVGCell(b *bytes.Buffer, x, y int, cell *gridCell) {
+	state := diagramPortState(cell.Port)
+	tooltip := cell.PortID
+	if d := cell.Port.Device; d != nil {
+		tooltip = fmt.Sprintf("%s: %s (%s:%s)", cell.PortID, d.Name, d.VendorID, d.ProductID)
+	}
+	fmt.Fprintf(b, "<g><title>%s</title>\n", html.EscapeString(tooltip))
+	fmt.Fprintf(b, "<rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" rx=\"4\" fill=\"%s\"/>\n",
+		x, y, svgCellWidth, svgCellHeight, portStateColors[state])
+	fmt.Fprintf(b, "<text x=\"%d\" y=\"%d\" class=\"port\">%s</text>\n", x+svgCellWidth/2, y+22, html.EscapeString(cell.Label))
+
+	// The device name, or the state of a switched off or faulted port
+	var note string
+	if state != portEmpty && state != portOccupied {
+		note = state
+	} else if d := cell.Port.Device; d != nil {
+		note = d.Name
+	}
+	if name := []rune(note); len(name) > svgNameLength {
+		note = string(name[:svgNameLength-1]) + "…"
+	}
+	if note != "" {
+		fmt.Fprintf(b, "<text x=\"%d\" y=\"%d\" class=\"device\">%s</text>\n", x+svgCellWidth/2, y+40, html.EscapeString(note))
+	}
+	b.WriteString("</g>\n")
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"embed"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// The frontend build is copied to web/dist by `make frontend` and compiled into the binary
+//
+//go:embed all:web
+var embeddedFrontend embed.FS
+
+// hashedAsset matches build output with a content hash in its name, e.g.
+// "assets/index-BwK3cR9x.js", which never changes and may be cached forever.
+// Only the build's assets directory is hashed; files copied from public/, like
+// "android-chrome-192x192.png", keep their names.
+var hashedAsset = regexp.MustCompile(`^assets/.+-[A-Za-z0-9_-]{8,}\.[a-z0-9]+$`)
+
+// frontendFiles returns the frontend to serve: the directory given with -static
+// or static_path, otherwise the embedded build. A binary built without the
+// frontend serves a page saying so.
+func frontendFiles() fs.FS {
+	if dir := config.Server.StaticPath; dir != "" {
+		log.Printf("Serving frontend from %s", dir)
+		return os.DirFS(dir)
+	}
+	if files, err := fs.Sub(embeddedFrontend, "web/dist"); err == nil {
+		if _, err := fs.Stat(files, "index.html"); err == nil {
+			return files
+		}
+	}
+	log.Printf("Warning: This build has no embedded frontend; run make to build it, or pass -static")
+	files, _ := fs.Sub(embeddedFrontend, "web/unbuilt")
+	return files
+}
+
+// spaHandler serves the single-page application. Paths that aren't files are
+// client-side routes and get the index page.
+type spaHandler struct {
+	files     fs.FS
+	indexPath string
+}
+
+func (h spaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if info, err := fs.Stat(h.files, name); err != nil || info.IsDir() {
+		// Missing assets and unknown API paths are errors, not routes
+		if path.Ext(name) != "" || name == "api" || strings.HasPrefix(name, "api/") {
+			http.NotFound(w, r)
+			return
+		}
+		name = h.indexPath
+	}
+
+	file, err := h.files.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	content, ok := file.(io.ReadSeeker)
+	if !ok {
+		http.Error(w, "File is not seekable", http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case name == h.indexPath:
+		// Always revalidate, so a new build's assets are picked up
+		w.Header().Set("Cache-Control", "no-cache")
+	case hashedAsset.MatchString(name):
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	default:
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+	}
+	http.ServeContent(w, r, name, info.ModTime(), content)
+}
@@ -4,4 +4,16 @@ go 1.21
 
 require github.com/gorilla/mux v1.8.1
 
-require github.com/BurntSushi/toml v1.6.0
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/eclipse/paho.mqtt.golang v1.4.3
+	go.etcd.io/bbolt v1.3.8
+	golang.org/x/term v0.6.0
+)
+
+require (
+	github.com/gorilla/websocket v1.5.0 // indirect
+	golang.org/x/net v0.8.0 // indirect
+	golang.org/x/sync v0.1.0 // indirect
+	golang.org/x/sys v0.6.0 // indirect
+)
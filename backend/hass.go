@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// hassDevice groups the entities of one hub in Home Assistant
+type hassDevice struct {
+	Identifiers []string `json:"identifiers"`
+	Name        string   `json:"name"`
+	Model       string   `json:"model,omitempty"`
+}
+
+// hassEntity is the discovery config of a Home Assistant entity
+type hassEntity struct {
+	Name              string     `json:"name"`
+	UniqueID          string     `json:"unique_id"`
+	ObjectID          string     `json:"object_id"`
+	StateTopic        string     `json:"state_topic"`
+	CommandTopic      string     `json:"command_topic,omitempty"`
+	AvailabilityTopic string     `json:"availability_topic"`
+	PayloadOn         string     `json:"payload_on,omitempty"`
+	PayloadOff        string     `json:"payload_off,omitempty"`
+	StateOn           string     `json:"state_on,omitempty"`
+	StateOff          string     `json:"state_off,omitempty"`
+	DeviceClass       string     `json:"device_class,omitempty"`
+	Icon              string     `json:"icon,omitempty"`
+	Device            hassDevice `json:"device"`
+}
+
+// publishDiscovery announces the physical ports of aggregated hubs to Home Assistant:
+// a switch for the port power, a binary sensor for device presence and a sensor with
+// the device name, grouped under one device per hub. It reports whether all configs
+// were published.
+func (b *mqttBridge) publishDiscovery(ports []mqttPort) bool {
+	for _, p := range ports {
+		if p.Hub == "" || p.MappedPort == 0 {
+			continue
+		}
+
+		node := mqttTopicName(b.prefix + "_" + p.Hub)
+		device := hassDevice{
+			Identifiers: []string{node},
+			Name:        p.Hub,
+			Model:       p.HubModel,
+		}
+		base := fmt.Sprintf("%s_port%d", node, p.MappedPort)
+
+		ok := true
+		announce := func(component string, e hassEntity) {
+			if !ok {
+				return
+			}
+			e.AvailabilityTopic = b.prefix + "/status"
+			e.Device = device
+			payload, _ := json.Marshal(e)
+			topic := fmt.Sprintf("%s/%s/%s/%s/config", b.discoveryPrefix, component, node, e.ObjectID)
+			ok = b.publish(topic, string(payload))
+		}
+
+		if b.commands {
+			announce("switch", hassEntity{
+				Name:         fmt.Sprintf("Port %d power", p.MappedPort),
+				UniqueID:     base + "_power",
+				ObjectID:     base + "_power",
+				StateTopic:   p.Topic + "/power",
+				CommandTopic: p.Topic + "/set",
+				PayloadOn:    "on",
+				PayloadOff:   "off",
+				StateOn:      "on",
+				StateOff:     "off",
+				Icon:         "mdi:usb-port",
+			})
+		}
+		announce("binary_sensor", hassEntity{
+			Name:        fmt.Sprintf("Port %d device present", p.MappedPort),
+			UniqueID:    base + "_present",
+			ObjectID:    base + "_present",
+			StateTopic:  p.Topic + "/present",
+			PayloadOn:   "true",
+			PayloadOff:  "false",
+			DeviceClass: "plug",
+		})
+		announce("sensor", hassEntity{
+			Name:       fmt.Sprintf("Port %d device", p.MappedPort),
+			UniqueID:   base + "_device",
+			ObjectID:   base + "_device",
+			StateTopic: p.Topic + "/name",
+			Icon:       "mdi:usb",
+		})
+
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
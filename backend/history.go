@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+// HistoryConfig configures the per-port event history store
+type HistoryConfig struct {
+	Disabled         bool   `toml:"disabled"`
+	Path             string `toml:"path"`                // Database file, default "hubcontrol-history.db"
+	Retention        string `toml:"retention"`           // Maximum age of events, e.g. "720h"
+	MaxEventsPerPort int    `toml:"max_events_per_port"` // Oldest events beyond this are dropped
+}
+
+const (
+	defaultHistoryPath      = "hubcontrol-history.db"
+	defaultHistoryRetention = 30 * 24 * time.Hour
+	defaultMaxEventsPerPort = 10000
+	historyPruneInterval    = time.Hour
+	defaultHistoryLimit     = 1000
+	historyQueueSize        = 1000
+	maxHistoryBatch         = 100
+)
+
+// historyStore persists port events in a bbolt database, one bucket per port ID.
+// Keys are the event time in nanoseconds followed by a sequence number, so a
+// cursor walks a port's events in chronological order.
+type historyStore struct {
+	db        *bolt.DB
+	retention time.Duration
+	maxEvents int
+	queue     chan PortEvent // Events waiting for the writer
+}
+
+var history *historyStore
+
+var portsBucket = []byte("ports")
+
+// openHistory opens the history database and starts recording events
+func openHistory() {
+	cfg := config.History
+	if cfg.Disabled {
+		return
+	}
+
+	path := cfg.Path
+	if path == "" {
+		path = defaultHistoryPath
+	}
+
+	retention := parseConfigDuration("history retention", cfg.Retention, defaultHistoryRetention)
+
+	maxEvents := cfg.MaxEventsPerPort
+	if maxEvents <= 0 {
+		maxEvents = defaultMaxEventsPerPort
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		log.Printf("Warning: Failed to open history database %s, port history disabled: %v", path, err)
+		return
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(portsBucket)
+		return err
+	}); err != nil {
+		log.Printf("Warning: Failed to initialize history database: %v", err)
+		db.Close()
+		return
+	}
+
+	history = &historyStore{db: db, retention: retention, maxEvents: maxEvents, queue: make(chan PortEvent, historyQueueSize)}
+	log.Printf("Recording port history in %s", path)
+
+	// Events are written by a separate goroutine so publishers never wait for the disk
+	go history.write()
+	subscribeEvents(func(event PortEvent) {
+		if event.PortID == "" {
+			return
+		}
+		select {
+		case history.queue <- event:
+		default:
+			log.Printf("Warning: History queue full, dropping %s event for port %s", event.Type, event.PortID)
+		}
+	})
+
+	go func() {
+		for {
+			history.prune()
+			time.Sleep(historyPruneInterval)
+		}
+	}()
+}
+
+// write stores queued events, batching the events that queued up while the
+// previous batch was written into a single transaction
+func (h *historyStore) write() {
+	for event := range h.queue {
+		batch := []PortEvent{event}
+	drain:
+		for len(batch) < maxHistoryBatch {
+			select {
+			case event := <-h.queue:
+				batch = append(batch, event)
+			default:
+				break drain
+			}
+		}
+		if err := h.add(batch...); err != nil {
+			log.Printf("Warning: Failed to record %d port event(s): %v", len(batch), err)
+		}
+	}
+}
+
+// add stores events under their ports
+func (h *historyStore) add(events ...PortEvent) error {
+	return h.db.Update(func(tx *bolt.Tx) error {
+		for _, event := range events {
+			if event.PortID == "" {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			bucket, err := tx.Bucket(portsBucket).CreateBucketIfNotExists([]byte(event.PortID))
+			if err != nil {
+				return err
+			}
+			seq, _ := bucket.NextSequence()
+			if err := bucket.Put(historyKey(event.Time, seq), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// portIDs returns the IDs of all ports with recorded events
+func (h *historyStore) portIDs() []string {
+	var ids []string
+	h.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(portsBucket).ForEachBucket(func(name []byte) error {
+			ids = append(ids, string(name))
+			return nil
+		})
+	})
+	return ids
+}
+
+// historyKey builds a sortable key from a time and sequence number
+func historyKey(t time.Time, seq uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key[:8], uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+// query returns events of a port between from and to (inclusive), oldest first.
+// If there are more than limit events, the most recent ones are returned.
+func (h *historyStore) query(portID string, from, to time.Time, types map[string]bool, limit int) ([]PortEvent, error) {
+	events := make([]PortEvent, 0)
+	err := h.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(portsBucket).Bucket([]byte(portID))
+		if bucket == nil {
+			return nil
+		}
+
+		// Walk backwards from the end of the range so limit keeps the newest events
+		c := bucket.Cursor()
+		k, v := c.Seek(historyKey(to, ^uint64(0)))
+		if k == nil {
+			k, v = c.Last()
+		} else if binary.BigEndian.Uint64(k[:8]) > uint64(to.UnixNano()) {
+			k, v = c.Prev()
+		}
+		for ; k != nil && len(events) < limit; k, v = c.Prev() {
+			if binary.BigEndian.Uint64(k[:8]) < uint64(from.UnixNano()) {
+				break
+			}
+			var event PortEvent
+			if err := json.Unmarshal(v, &event); err != nil {
+				continue
+			}
+			if len(types) > 0 && !types[event.Type] {
+				continue
+			}
+			events = append(events, event)
+		}
+		return nil
+	})
+
+	// Return in chronological order
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events, err
+}
+
+// prune drops events older than the retention period and beyond the per-port limit
+func (h *historyStore) prune() {
+	cutoff := historyKey(time.Now().Add(-h.retention), 0)
+	err := h.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(portsBucket).ForEachBucket(func(name []byte) error {
+			bucket := tx.Bucket(portsBucket).Bucket(name)
+			excess := bucket.Stats().KeyN - h.maxEvents
+
+			// Collect first, deleting while iterating a cursor skips keys
+			var stale [][]byte
+			c := bucket.Cursor()
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				if excess <= 0 && string(k) >= string(cutoff) {
+					break
+				}
+				stale = append(stale, append([]byte(nil), k...))
+				excess--
+			}
+			for _, k := range stale {
+				if err := bucket.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("Warning: Failed to prune port history: %v", err)
+	}
+}
+
+// parseHistoryTime parses an RFC 3339 time or a duration meaning that long ago (e.g. "24h")
+func parseHistoryTime(value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// getPortHistory returns recorded events for a port ID such as "1-3.2".
+// Query parameters: from, to (RFC 3339 or a duration ago), type (comma separated), limit.
+func getPortHistory(w http.ResponseWriter, r *http.Request) {
+	if history == nil {
+		http.Error(w, "Port history is disabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	portID := mux.Vars(r)["id"]
+	query := r.URL.Query()
+
+	from, err := parseHistoryTime(query.Get("from"), time.Unix(0, 0))
+	if err != nil {
+		http.Error(w, "Invalid from: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseHistoryTime(query.Get("to"), time.Now())
+	if err != nil {
+		http.Error(w, "Invalid to: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	types := make(map[string]bool)
+	if t := query.Get("type"); t != "" {
+		for _, name := range strings.Split(t, ",") {
+			types[strings.TrimSpace(name)] = true
+		}
+	}
+
+	limit := defaultHistoryLimit
+	if l := query.Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	events, err := history.query(portID, from, to, types, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// InventoryItem is a device attached to a hub, for asset management
+type InventoryItem struct {
+	Bus          int    `json:"bus"`
+	Device       int    `json:"device"`
+	Location     string `json:"location"`             // Port ID, e.g. "1-3.1.2"
+	HubName      string `json:"hubName"`              // Aggregated hub, or the hub the device is plugged into
+	MappedPort   int    `json:"mappedPort,omitempty"` // Physical port number on an aggregated hub
+	PortKey      string `json:"portKey,omitempty"`
+	VendorID     string `json:"vendorId"`
+	ProductID    string `json:"productId"`
+	Name         string `json:"name"`                   // From the usb.ids database
+	Manufacturer string `json:"manufacturer,omitempty"` // From the device's string descriptors
+	Product      string `json:"product,omitempty"`
+	Serial       string `json:"serial,omitempty"`
+	Class        string `json:"class"`
+	Speed        string `json:"speed"`
+	Driver       string `json:"driver"`
+}
+
+// inventoryCSVHeader are the CSV columns, in the order of csvRecord
+var inventoryCSVHeader = []string{
+	"bus", "device", "location", "hub_name", "mapped_port", "port_key", "vendor_id", "product_id",
+	"name", "manufacturer", "product", "serial", "class", "speed", "driver",
+}
+
+// csvRecord returns the item as CSV fields
+func (item InventoryItem) csvRecord() []string {
+	mappedPort := ""
+	if item.MappedPort > 0 {
+		mappedPort = strconv.Itoa(item.MappedPort)
+	}
+	record := []string{
+		strconv.Itoa(item.Bus), strconv.Itoa(item.Device), item.Location, item.HubName, mappedPort, item.PortKey,
+		item.VendorID, item.ProductID, item.Name, item.Manufacturer, item.Product, item.Serial,
+		item.Class, item.Speed, item.Driver,
+	}
+	for i, field := range record {
+		record[i] = csvSafe(field)
+	}
+	return record
+}
+
+// csvSafe keeps spreadsheets from evaluating a field as a formula. Device strings
+// come from the devices themselves, so a field starting with =, +, -, @, a tab or
+// a carriage return is prefixed with a quote.
+func csvSafe(field string) string {
+	if field != "" && strings.ContainsRune("=+-@\t\r", rune(field[0])) {
+		return "'" + field
+	}
+	return field
+}
+
+// buildInventory lists every device below the root hubs of a raw topology that
+// matches a query, including the hubs themselves, with the hub names and mapped
+// ports of the aggregated view
+func buildInventory(raw *USBTopology, query DeviceQuery) []InventoryItem {
+	items := make([]InventoryItem, 0)
+	searchDevices(raw, query, func(found attachedDevice) {
+		device := found.Device
+		items = append(items, InventoryItem{
+			Bus:          found.Bus,
+			Device:       device.Device,
+			Location:     found.PortID,
+			HubName:      found.HubName,
+			MappedPort:   found.Ref.MappedPort,
+			PortKey:      found.Ref.PortKey,
+			VendorID:     device.VendorID,
+			ProductID:    device.ProductID,
+			Name:         device.Name,
+			Manufacturer: device.Manufacturer,
+			Product:      device.Product,
+			Serial:       device.Serial,
+			Class:        device.Class,
+			Speed:        device.Speed,
+			Driver:       device.Driver,
+		})
+	})
+	return items
+}
+
+// getInventory lists the attached devices as JSON or, with format=csv, as CSV
+func getInventory(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		http.Error(w, "Unknown format, use json or csv", http.StatusBadRequest)
+		return
+	}
+	filter := DeviceQuery{
+		Hub:    query.Get("hub"),
+		Vendor: query.Get("vendor"),
+		Class:  query.Get("class"),
+		Driver: query.Get("driver"),
+		Speed:  query.Get("speed"),
+	}
+
+	topology, err := parseUSBTopology()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	items := buildInventory(topology, filter)
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="usb-inventory.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write(inventoryCSVHeader)
+		for _, item := range items {
+			cw.Write(item.csvRecord())
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			log.Printf("Warning: Failed to write inventory CSV: %v", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
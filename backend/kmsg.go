@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// KernelLogConfig configures the kernel log reader
+type KernelLogConfig struct {
+	Disabled     bool   `toml:"disabled"`
+	Path         string `toml:"path"`          // Defaults to /dev/kmsg; a regular file is tailed instead
+	RecentEvents int    `toml:"recent_events"` // Number of recent events kept in memory
+}
+
+// KernelEvent is a USB error reported by the kernel, attributed to a port
+type KernelEvent struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`   // EventOverCurrent or EventEnumError
+	PortID     string    `json:"portId"` // Kernel name of the port, e.g. "1-3.2"
+	Bus        int       `json:"bus"`
+	Location   string    `json:"location"` // USB path of the port, e.g. "3.2"
+	PortKey    string    `json:"portKey,omitempty"`
+	MappedPort int       `json:"mappedPort,omitempty"`
+	Message    string    `json:"message"`
+}
+
+// PortErrorCounters counts kernel-reported errors for a single port
+type PortErrorCounters struct {
+	OverCurrent int       `json:"overCurrent"`
+	EnumErrors  int       `json:"enumErrors"`
+	LastError   time.Time `json:"lastError"`
+	LastMessage string    `json:"lastMessage"`
+}
+
+const (
+	defaultKmsgPath       = "/dev/kmsg"
+	defaultRecentEvents   = 200
+	kernelLogPollInterval = time.Second
+)
+
+var (
+	// Kernel device names: "usb1-port3", "1-3-port2", "1-3.2" or interfaces like "1-3:1.0"
+	kernelDeviceRe = regexp.MustCompile(`^(?:usb|hub) (usb\d+-port\d+|\d+-[\d.]+-port\d+|\d+-[\d.]+(?::\d+\.\d+)?): (.*)$`)
+	onPortRe       = regexp.MustCompile(`on port (\d+)`)
+	overCurrentRe  = regexp.MustCompile(`(?i)over-current (change|condition)`)
+	enumErrorRe    = regexp.MustCompile(`(?i)(device descriptor read/\d+, error|device not accepting address|unable to enumerate USB device|cannot enable\. Maybe the USB cable is bad|can't set config|cannot reset)`)
+	dmesgPrefixRe  = regexp.MustCompile(`^\[\s*(\d+\.\d+)\]\s*`)
+)
+
+// kernelLogStore holds per-port error counters and a ring of recent events
+type kernelLogStore struct {
+	mu       sync.Mutex
+	counters map[string]*PortErrorCounters
+	recent   []KernelEvent
+	limit    int
+}
+
+var kernelLog = &kernelLogStore{
+	counters: make(map[string]*PortErrorCounters),
+	limit:    defaultRecentEvents,
+}
+
+// record stores an event and updates the counters of its port
+func (s *kernelLogStore) record(event KernelEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.counters[event.PortID]
+	if c == nil {
+		c = &PortErrorCounters{}
+		s.counters[event.PortID] = c
+	}
+	switch event.Type {
+	case EventOverCurrent:
+		c.OverCurrent++
+	case EventEnumError:
+		c.EnumErrors++
+	}
+	c.LastError = event.Time
+	c.LastMessage = event.Message
+
+	s.recent = append(s.recent, event)
+	if len(s.recent) > s.limit {
+		s.recent = s.recent[len(s.recent)-s.limit:]
+	}
+}
+
+// portCounters returns a copy of the counters for a port, or nil if it has no errors
+func (s *kernelLogStore) portCounters(portID string) *PortErrorCounters {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.counters[portID]
+	if !ok {
+		return nil
+	}
+	copied := *c
+	return &copied
+}
+
+// parseKernelDevice converts a kernel device name into a bus and USB port path.
+// Port devices ("1-3-port2") and hub interfaces with a port number resolve to
+// the port itself; device names ("1-3.2") resolve to the port they are plugged into.
+func parseKernelDevice(name string, port int) (int, string, bool) {
+	var busStr, path string
+	switch {
+	case strings.HasPrefix(name, "usb") && strings.Contains(name, "-port"):
+		// Root hub port: usb1-port3
+		parts := strings.SplitN(strings.TrimPrefix(name, "usb"), "-port", 2)
+		busStr, path = parts[0], parts[1]
+	case strings.Contains(name, "-port"):
+		// Hub port: 1-3.1-port2
+		parts := strings.SplitN(name, "-port", 2)
+		hub := strings.SplitN(parts[0], "-", 2)
+		busStr, path = hub[0], hub[1]+"."+parts[1]
+	default:
+		// Device or interface: 1-3.2 or 1-3:1.0
+		name = strings.SplitN(name, ":", 2)[0]
+		parts := strings.SplitN(name, "-", 2)
+		if len(parts) != 2 {
+			return 0, "", false
+		}
+		busStr, path = parts[0], parts[1]
+		if port > 0 {
+			// "hub 1-3:1.0: ... on port 2" refers to a port of the hub itself
+			if path == "0" {
+				path = strconv.Itoa(port)
+			} else {
+				path = joinPortPath(path, port)
+			}
+		}
+	}
+
+	bus, err := strconv.Atoi(busStr)
+	if err != nil || path == "" {
+		return 0, "", false
+	}
+	return bus, path, true
+}
+
+// parseKernelLine turns a kernel log line into an event, or returns false if it is
+// not a USB error. Lines may be in /dev/kmsg format ("6,1234,5678,-;msg"),
+// dmesg format ("[ 12.345678] msg") or plain messages.
+func parseKernelLine(line string, bootTime time.Time) (KernelEvent, bool) {
+	ts := time.Now()
+	msg := line
+
+	if idx := strings.Index(line, ";"); idx > 0 && strings.Count(line[:idx], ",") >= 2 {
+		// kmsg record: priority,sequence,timestamp_us,flags;message
+		fields := strings.Split(line[:idx], ",")
+		if us, err := strconv.ParseInt(fields[2], 10, 64); err == nil && !bootTime.IsZero() {
+			ts = bootTime.Add(time.Duration(us) * time.Microsecond)
+		}
+		msg = line[idx+1:]
+	} else if m := dmesgPrefixRe.FindStringSubmatch(line); m != nil {
+		if secs, err := strconv.ParseFloat(m[1], 64); err == nil && !bootTime.IsZero() {
+			ts = bootTime.Add(time.Duration(secs * float64(time.Second)))
+		}
+		msg = line[len(m[0]):]
+	}
+
+	m := kernelDeviceRe.FindStringSubmatch(msg)
+	if m == nil {
+		return KernelEvent{}, false
+	}
+
+	var eventType string
+	switch {
+	case overCurrentRe.MatchString(m[2]):
+		eventType = EventOverCurrent
+	case enumErrorRe.MatchString(m[2]):
+		eventType = EventEnumError
+	default:
+		return KernelEvent{}, false
+	}
+
+	port := 0
+	if pm := onPortRe.FindStringSubmatch(m[2]); pm != nil {
+		port, _ = strconv.Atoi(pm[1])
+	}
+	bus, path, ok := parseKernelDevice(m[1], port)
+	if !ok {
+		return KernelEvent{}, false
+	}
+
+	return KernelEvent{
+		Time:     ts,
+		Type:     eventType,
+		PortID:   sysfsName(bus, path),
+		Bus:      bus,
+		Location: path,
+		Message:  strings.TrimSpace(msg),
+	}, true
+}
+
+// systemBootTime estimates the wall clock time the system booted from /proc/uptime
+func systemBootTime() time.Time {
+	data, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return time.Time{}
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return time.Time{}
+	}
+	secs, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Now().Add(-time.Duration(secs * float64(time.Second)))
+}
+
+// startKernelLogReader starts reading USB errors from the kernel log in the background
+func startKernelLogReader() {
+	cfg := config.KernelLog
+	if cfg.Disabled {
+		return
+	}
+	if cfg.RecentEvents > 0 {
+		kernelLog.limit = cfg.RecentEvents
+	}
+	path := cfg.Path
+	if path == "" {
+		path = defaultKmsgPath
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf("Warning: Kernel log unavailable, USB error tracking disabled: %v", err)
+		return
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		log.Printf("Warning: Failed to stat kernel log %s: %v", path, err)
+		return
+	}
+
+	bootTime := systemBootTime()
+	kernelLogStarted = time.Now()
+	log.Printf("Reading USB errors from %s", path)
+	if info.Mode().IsRegular() {
+		go tailKernelLogFile(f, bootTime)
+	} else {
+		go readKmsg(f, bootTime)
+	}
+}
+
+// kernelLogStarted is when the reader started; records replayed from before that
+// are counted but not published again as port events
+var kernelLogStarted = time.Now()
+
+// handleKernelLine records a kernel log line if it describes a USB error
+func handleKernelLine(line string, bootTime time.Time) {
+	if event, ok := parseKernelLine(line, bootTime); ok {
+		kernelLog.record(event)
+		if event.Time.Before(kernelLogStarted) {
+			return
+		}
+		publishEvent(PortEvent{
+			Time:     event.Time,
+			Type:     event.Type,
+			PortID:   event.PortID,
+			Bus:      event.Bus,
+			Location: event.Location,
+			Source:   "kernel",
+			Message:  event.Message,
+		})
+	}
+}
+
+// readKmsg reads /dev/kmsg, where every read returns exactly one record
+func readKmsg(f *os.File, bootTime time.Time) {
+	defer f.Close()
+	buf := make([]byte, 8192)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			// EPIPE means records were overwritten before we read them; keep going
+			if errors.Is(err, syscall.EPIPE) {
+				continue
+			}
+			log.Printf("Warning: Stopped reading kernel log: %v", err)
+			return
+		}
+		// Continuation lines with key=value pairs follow the first line
+		line := strings.SplitN(string(buf[:n]), "\n", 2)[0]
+		handleKernelLine(line, bootTime)
+	}
+}
+
+// tailKernelLogFile reads a regular file line by line and follows appended lines,
+// standing in for /dev/kmsg when testing against recorded logs
+func tailKernelLogFile(f *os.File, bootTime time.Time) {
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	var partial string
+	for {
+		line, err := reader.ReadString('\n')
+		partial += line
+		if err == io.EOF {
+			time.Sleep(kernelLogPollInterval)
+			continue
+		}
+		if err != nil {
+			log.Printf("Warning: Stopped reading kernel log: %v", err)
+			return
+		}
+		handleKernelLine(strings.TrimRight(partial, "\r\n"), bootTime)
+		partial = ""
+	}
+}
+
+// annotateKernelErrors attaches error counters to the ports of a topology
+func annotateKernelErrors(topology *USBTopology) {
+	walkPorts(topology, func(bus int, path string, port *USBPort) {
+		port.Errors = kernelLog.portCounters(sysfsName(bus, path))
+	})
+}
+
+// resolvePortKeys fills in PortKey and MappedPort of events from an aggregated topology
+func resolvePortKeys(events []KernelEvent, topology *USBTopology) {
+	ports := make(map[string]*USBPort)
+	walkPorts(topology, func(bus int, path string, port *USBPort) {
+		ports[sysfsName(bus, path)] = port
+	})
+	for i := range events {
+		if port, ok := ports[events[i].PortID]; ok {
+			events[i].PortKey = port.PortKey
+			events[i].MappedPort = port.MappedPort
+		}
+	}
+}
+
+// getKernelEvents returns recent USB errors from the kernel log, optionally
+// filtered by port ID ("1-3.2") or event type
+func getKernelEvents(w http.ResponseWriter, r *http.Request) {
+	portFilter := r.URL.Query().Get("port")
+	typeFilter := r.URL.Query().Get("type")
+
+	kernelLog.mu.Lock()
+	events := make([]KernelEvent, 0, len(kernelLog.recent))
+	for _, e := range kernelLog.recent {
+		if (portFilter == "" || e.PortID == portFilter) && (typeFilter == "" || e.Type == typeFilter) {
+			events = append(events, e)
+		}
+	}
+	counters := make(map[string]PortErrorCounters, len(kernelLog.counters))
+	for id, c := range kernelLog.counters {
+		if portFilter == "" || id == portFilter {
+			counters[id] = *c
+		}
+	}
+	kernelLog.mu.Unlock()
+
+	// Attribute events to mapped ports when the topology is available
+	if topology, err := parseUSBTopology(); err == nil {
+		resolvePortKeys(events, aggregateTopology(topology))
+	}
+
+	response := map[string]interface{}{
+		"counters": counters,
+		"events":   events,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
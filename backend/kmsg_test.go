@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"testing"
+	"time"
+)
+
+// A hub with two child hubs and a device on its own port 5, aggregated as "Test Hub"
+const kmsgTestTree = `/:  Bus 001.Port 001: Dev 001, Class=root_hub, Driver=xhci_hcd/4p, 480M
+    |__ Port 003: Dev 009, If 0, Class=Hub, Driver=hub/7p, 480M
+        |__ Port 001: Dev 010, If 0, Class=Hub, Driver=hub/4p, 480M
+            |__ Port 002: Dev 020, If 0, Class=Vendor Specific Class, Driver=ftdi_sio, 12M
+            |__ Port 003: Dev 021, If 0, Class=Mass Storage, Driver=usb-storage, 480M
+        |__ Port 002: Dev 011, If 0, Class=Hub, Driver=hub/4p, 480M
+        |__ Port 005: Dev 012, If 0, Class=Human Interface Device, Driver=usbhid, 12M
+`
+
+const kmsgTestList = `Bus 001 Device 001: ID 1d6b:0002 Linux Foundation 2.0 root hub
+Bus 001 Device 009: ID 1a40:0201 Terminus Technology Inc. FE 2.1 7-port Hub
+Bus 001 Device 010: ID 1a40:0101 Terminus Technology Inc. Hub
+Bus 001 Device 011: ID 1a40:0101 Terminus Technology Inc. Hub
+Bus 001 Device 020: ID 0403:6001 FTDI FT232
+Bus 001 Device 021: ID 0781:5581 SanDisk Ultra
+Bus 001 Device 012: ID 046d:c52b Logitech Receiver
+`
+
+func TestParseKernelLog(t *testing.T) {
+	// One entry per line of testdata/kmsg.log; an empty type means the line is ignored
+	lines := []struct {
+		eventType string
+		portID    string
+	}{
+		{"", ""},                      // kmsg, not an error
+		{EventEnumError, "1-3.1.2"},   // kmsg, device name
+		{EventEnumError, "1-3.1.2"},   // kmsg, device name
+		{EventOverCurrent, "1-3"},     // dmesg, root hub port
+		{EventOverCurrent, "1-3.1.3"}, // hub interface with "on port"
+		{EventEnumError, "1-3.1.3"},   // kmsg, device interface
+		{EventOverCurrent, "1-2"},     // root hub interface with "on port"
+		{EventEnumError, "1-3.5"},     // hub port device
+		{"", ""},                      // kmsg, not USB
+	}
+
+	f, err := os.Open("testdata/kmsg.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	bootTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := &kernelLogStore{counters: make(map[string]*PortErrorCounters), limit: defaultRecentEvents}
+	scanner := bufio.NewScanner(f)
+	for i := 0; scanner.Scan(); i++ {
+		if i >= len(lines) {
+			t.Fatalf("unexpected line %d: %q", i+1, scanner.Text())
+		}
+		want := lines[i]
+		event, ok := parseKernelLine(scanner.Text(), bootTime)
+		if ok != (want.eventType != "") {
+			t.Errorf("line %d: parsed = %v, want %v", i+1, ok, !ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if event.Type != want.eventType || event.PortID != want.portID {
+			t.Errorf("line %d: got %s on %s, want %s on %s", i+1, event.Type, event.PortID, want.eventType, want.portID)
+		}
+		if event.Bus != 1 || sysfsName(event.Bus, event.Location) != event.PortID {
+			t.Errorf("line %d: bus %d, location %q do not match port %s", i+1, event.Bus, event.Location, event.PortID)
+		}
+		store.record(event)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	counters := []struct {
+		portID      string
+		overCurrent int
+		enumErrors  int
+	}{
+		{"1-3.1.2", 0, 2},
+		{"1-3.1.3", 1, 1},
+		{"1-3", 1, 0},
+		{"1-2", 1, 0},
+		{"1-3.5", 0, 1},
+	}
+	for _, want := range counters {
+		c := store.portCounters(want.portID)
+		if c == nil {
+			t.Errorf("%s: no counters", want.portID)
+			continue
+		}
+		if c.OverCurrent != want.overCurrent || c.EnumErrors != want.enumErrors {
+			t.Errorf("%s: %d over-current, %d enumeration errors, want %d and %d",
+				want.portID, c.OverCurrent, c.EnumErrors, want.overCurrent, want.enumErrors)
+		}
+	}
+	if c := store.portCounters("1-3.1.4"); c != nil {
+		t.Errorf("1-3.1.4: unexpected counters %+v", c)
+	}
+
+	// The first error is stamped from the kmsg timestamp relative to boot
+	if got, want := store.recent[0].Time, bootTime.Add(4530*time.Millisecond); !got.Equal(want) {
+		t.Errorf("first event at %s, want %s", got, want)
+	}
+}
+
+func TestResolvePortKeys(t *testing.T) {
+	saved := config.Hubs
+	defer func() { config.Hubs = saved }()
+	config.Hubs = []HubConfig{{VendorID: "1a40", ProductID: "0201", Name: "Test Hub", PortMap: map[string]int{"1.2": 7}}}
+
+	topology := aggregateTopology(parseTreeOutput(kmsgTestTree, parseDeviceList(kmsgTestList)))
+	events := []KernelEvent{
+		{PortID: "1-3.1.2"}, // Mapped in the config
+		{PortID: "1-3.2.1"}, // On the second child hub
+		{PortID: "1-3.5"},   // On the aggregated hub itself
+		{PortID: "1-2"},     // Root hub port, not aggregated
+	}
+	resolvePortKeys(events, topology)
+
+	want := []struct {
+		portKey    string
+		mappedPort int
+	}{
+		{"1.2", 7},
+		{"2.1", 4},
+		{"0.5", 9},
+		{"", 0},
+	}
+	for i, w := range want {
+		if events[i].PortKey != w.portKey || events[i].MappedPort != w.mappedPort {
+			t.Errorf("%s: port key %q, mapped port %d, want %q and %d",
+				events[i].PortID, events[i].PortKey, events[i].MappedPort, w.portKey, w.mappedPort)
+		}
+	}
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// LeaseConfig configures port leases
+type LeaseConfig struct {
+	StateFile       string `toml:"state_file"`       // Where active leases are kept across restarts
+	DefaultDuration string `toml:"default_duration"` // Used when a request gives no duration, default 1h
+	MaxDuration     string `toml:"max_duration"`     // Longest lease or extension, default 24h
+}
+
+const (
+	defaultLeaseStateFile = "hubcontrol-leases.json"
+	defaultLeaseDuration  = time.Hour
+	defaultLeaseMax       = 24 * time.Hour
+	leaseExpiryInterval   = time.Second
+)
+
+// PortLease reserves ports for one owner. While it is active, power actions on its
+// ports by anyone else are rejected. Without authentication the ID is the holder's
+// only credential, so it is returned when the lease is acquired and never listed.
+type PortLease struct {
+	ID       string    `json:"id,omitempty"`
+	PortIDs  []string  `json:"portIds"`
+	Owner    string    `json:"owner"`
+	Reason   string    `json:"reason,omitempty"`
+	Acquired time.Time `json:"acquired"`
+	Expires  time.Time `json:"expires"`
+}
+
+// public returns the lease without its ID, for listings
+func (lease PortLease) public() PortLease {
+	lease.ID = ""
+	return lease
+}
+
+// visibleTo returns the lease as listed to a request: with its ID for those who may
+// manage it under authentication, so an owner who lost the ID can still release it
+func (lease PortLease) visibleTo(r *http.Request) PortLease {
+	if authEnabled() && mayManageLease(r, lease) {
+		return lease
+	}
+	return lease.public()
+}
+
+// LeaseRequest asks for a lease on a set of ports
+type LeaseRequest struct {
+	PortSet
+	Owner    string `json:"owner,omitempty"` // Required without authentication, otherwise the token name
+	Reason   string `json:"reason,omitempty"`
+	Duration string `json:"duration,omitempty"` // e.g. "30m"
+}
+
+// leaseSet holds the active leases
+type leaseSet struct {
+	mu        sync.Mutex
+	leases    map[string]*PortLease
+	byPort    map[string]string // Port ID -> lease ID
+	stateFile string
+	defaultD  time.Duration
+	maxD      time.Duration
+}
+
+var portLeases = &leaseSet{
+	leases:   make(map[string]*PortLease),
+	byPort:   make(map[string]string),
+	defaultD: defaultLeaseDuration,
+	maxD:     defaultLeaseMax,
+}
+
+// startLeases restores leases from the state file and expires them in the background
+func startLeases() {
+	loadLeases()
+	go func() {
+		for {
+			portLeases.expire(time.Now())
+			time.Sleep(leaseExpiryInterval)
+		}
+	}()
+}
+
+// loadLeases applies the lease config and restores the leases from the state file
+func loadLeases() {
+	l := portLeases
+	l.stateFile = config.Leases.StateFile
+	if l.stateFile == "" {
+		l.stateFile = defaultLeaseStateFile
+	}
+	l.defaultD = parseConfigDuration("lease default_duration", config.Leases.DefaultDuration, defaultLeaseDuration)
+	l.maxD = parseConfigDuration("lease max_duration", config.Leases.MaxDuration, defaultLeaseMax)
+
+	if data, err := os.ReadFile(l.stateFile); err == nil {
+		var saved []*PortLease
+		if err := json.Unmarshal(data, &saved); err != nil {
+			log.Printf("Warning: Failed to parse leases from %s: %v", l.stateFile, err)
+		}
+		l.mu.Lock()
+		for _, lease := range saved {
+			l.leases[lease.ID] = lease
+			for _, portID := range lease.PortIDs {
+				l.byPort[portID] = lease.ID
+			}
+		}
+		l.mu.Unlock()
+		if len(saved) > 0 {
+			log.Printf("Restored %d port lease(s)", len(saved))
+		}
+	}
+}
+
+// newLeaseID returns a random lease ID
+func newLeaseID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// forPort returns the active lease on a port
+func (l *leaseSet) forPort(portID string) (PortLease, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	id, ok := l.byPort[portID]
+	if !ok {
+		return PortLease{}, false
+	}
+	lease := l.leases[id]
+	if !time.Now().Before(lease.Expires) {
+		// Expired but not yet swept
+		return PortLease{}, false
+	}
+	return *lease, true
+}
+
+// get returns a lease by ID
+func (l *leaseSet) get(id string) (PortLease, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lease, ok := l.leases[id]
+	if !ok {
+		return PortLease{}, false
+	}
+	return *lease, true
+}
+
+// acquire adds a lease unless one of its ports is leased already
+func (l *leaseSet) acquire(lease *PortLease) error {
+	l.mu.Lock()
+	now := time.Now()
+	for _, portID := range lease.PortIDs {
+		if id, ok := l.byPort[portID]; ok && now.Before(l.leases[id].Expires) {
+			other := l.leases[id]
+			l.mu.Unlock()
+			return fmt.Errorf("port %s is leased by %s until %s", portID, other.Owner, other.Expires.Format(time.RFC3339))
+		}
+	}
+	l.leases[lease.ID] = lease
+	for _, portID := range lease.PortIDs {
+		l.byPort[portID] = lease.ID
+	}
+	l.save()
+	l.mu.Unlock()
+
+	log.Printf("Lease %s: %s acquired %s until %s", lease.ID, lease.Owner, strings.Join(lease.PortIDs, ", "), lease.Expires.Format(time.RFC3339))
+	publishLeaseEvents(EventLeaseAcquired, *lease, fmt.Sprintf("leased by %s until %s", lease.Owner, lease.Expires.Format(time.RFC3339)))
+	return nil
+}
+
+// extend moves the expiry of a lease back by d, to at most the maximum duration from now
+func (l *leaseSet) extend(id string, d time.Duration) (PortLease, bool) {
+	l.mu.Lock()
+	lease, ok := l.leases[id]
+	if !ok {
+		l.mu.Unlock()
+		return PortLease{}, false
+	}
+	now := time.Now()
+	if lease.Expires.Before(now) {
+		lease.Expires = now
+	}
+	lease.Expires = lease.Expires.Add(d)
+	if limit := now.Add(l.maxD); lease.Expires.After(limit) {
+		lease.Expires = limit
+	}
+	l.save()
+	extended := *lease
+	l.mu.Unlock()
+
+	log.Printf("Lease %s of %s extended until %s", extended.ID, extended.Owner, extended.Expires.Format(time.RFC3339))
+	publishLeaseEvents(EventLeaseExtended, extended, fmt.Sprintf("lease of %s extended until %s", extended.Owner, extended.Expires.Format(time.RFC3339)))
+	return extended, true
+}
+
+// release removes a lease
+func (l *leaseSet) release(id, reason string) bool {
+	l.mu.Lock()
+	lease, ok := l.leases[id]
+	if ok {
+		l.remove(lease)
+		l.save()
+	}
+	l.mu.Unlock()
+
+	if ok {
+		log.Printf("Lease %s of %s %s", lease.ID, lease.Owner, reason)
+		publishLeaseEvents(EventLeaseReleased, *lease, fmt.Sprintf("lease of %s %s", lease.Owner, reason))
+	}
+	return ok
+}
+
+// remove drops a lease; the caller holds l.mu
+func (l *leaseSet) remove(lease *PortLease) {
+	delete(l.leases, lease.ID)
+	for _, portID := range lease.PortIDs {
+		if l.byPort[portID] == lease.ID {
+			delete(l.byPort, portID)
+		}
+	}
+}
+
+// expire releases all leases that ran out
+func (l *leaseSet) expire(now time.Time) {
+	l.mu.Lock()
+	var expired []string
+	for id, lease := range l.leases {
+		if !now.Before(lease.Expires) {
+			expired = append(expired, id)
+		}
+	}
+	l.mu.Unlock()
+
+	for _, id := range expired {
+		if lease, ok := l.get(id); ok && l.release(id, "expired") {
+			recordAudit(leaseAudit(AuditEntry{Actor: "system", Operation: "lease_expire", Result: AuditOK}, lease))
+		}
+	}
+}
+
+// list returns all active leases, oldest first
+func (l *leaseSet) list() []PortLease {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	leases := make([]PortLease, 0, len(l.leases))
+	for _, lease := range l.leases {
+		leases = append(leases, *lease)
+	}
+	sort.Slice(leases, func(i, j int) bool { return leases[i].Acquired.Before(leases[j].Acquired) })
+	return leases
+}
+
+// save writes the leases to the state file; the caller holds l.mu
+func (l *leaseSet) save() {
+	leases := make([]*PortLease, 0, len(l.leases))
+	for _, lease := range l.leases {
+		leases = append(leases, lease)
+	}
+	data, err := json.MarshalIndent(leases, "", "  ")
+	if err == nil {
+		// The IDs are credentials without authentication
+		err = os.WriteFile(l.stateFile, data, 0600)
+	}
+	if err == nil {
+		// WriteFile keeps the mode of an existing file, which used to be world-readable
+		err = os.Chmod(l.stateFile, 0600)
+	}
+	if err != nil {
+		log.Printf("Warning: Failed to save leases: %v", err)
+	}
+}
+
+// publishLeaseEvents records a lease event on every port of the lease
+func publishLeaseEvents(eventType string, lease PortLease, message string) {
+	for _, portID := range lease.PortIDs {
+		bus, path, _ := splitPortID(portID)
+		publishEvent(PortEvent{
+			Type:     eventType,
+			PortID:   portID,
+			Bus:      bus,
+			Location: path,
+			Source:   "lease:" + lease.Owner,
+			Message:  message,
+		})
+	}
+}
+
+// checkLease returns an error if a port is leased to someone other than the given lease
+func checkLease(portID, leaseID string) error {
+	if lease, ok := portLeases.forPort(portID); ok && lease.ID != leaseID {
+		return fmt.Errorf("port %s is leased by %s until %s", portID, lease.Owner, lease.Expires.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// requestLeaseID returns the lease a request acts under for a port. With
+// authentication, that is the lease on the port if the caller's token holds it;
+// without, the lease ID the request presents, in the body or a header.
+func requestLeaseID(r *http.Request, portID, presented string) string {
+	if authEnabled() {
+		lease, ok := portLeases.forPort(portID)
+		if token, authed := requestToken(r); ok && authed && token.Name == lease.Owner {
+			return lease.ID
+		}
+		return ""
+	}
+	if presented == "" {
+		presented = r.Header.Get("X-Hubcontrol-Lease")
+	}
+	return presented
+}
+
+// mayManageLease reports whether a request may extend or release a lease: with
+// authentication, only its owner and admins may; without it, anyone knowing the ID
+func mayManageLease(r *http.Request, lease PortLease) bool {
+	if !authEnabled() {
+		return true
+	}
+	token, authed := requestToken(r)
+	return authed && (token.Name == lease.Owner || token.Scope == ScopeAdmin)
+}
+
+// annotatePortLeases adds active leases to the ports of a topology
+func annotatePortLeases(topology *USBTopology) {
+	walkPorts(topology, func(bus int, path string, port *USBPort) {
+		if lease, ok := portLeases.forPort(sysfsName(bus, path)); ok {
+			lease = lease.public()
+			port.Lease = &lease
+		}
+	})
+}
+
+// parseRequestedDuration parses a requested lease duration, capped at the maximum
+func parseRequestedDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return portLeases.defaultD, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	if d > portLeases.maxD {
+		return 0, fmt.Errorf("duration %s exceeds the maximum of %s", d, portLeases.maxD)
+	}
+	return d, nil
+}
+
+// listLeases returns the active leases, with IDs only where visibleTo allows
+func listLeases(w http.ResponseWriter, r *http.Request) {
+	leases := portLeases.list()
+	for i := range leases {
+		leases[i] = leases[i].visibleTo(r)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(leases)
+}
+
+// acquireLease leases a set of ports to the caller
+func acquireLease(w http.ResponseWriter, r *http.Request) {
+	var req LeaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if token, ok := requestToken(r); ok {
+		req.Owner = token.Name
+	}
+	if req.Owner == "" {
+		http.Error(w, "owner is required", http.StatusBadRequest)
+		return
+	}
+	d, err := parseRequestedDuration(req.Duration)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, aggregated := monitor.snapshot()
+	if aggregated == nil {
+		http.Error(w, "Topology not scanned yet", http.StatusServiceUnavailable)
+		return
+	}
+	portIDs, err := resolvePortSet(aggregated, req.PortSet)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(portIDs) == 0 {
+		http.Error(w, "No ports given", http.StatusBadRequest)
+		return
+	}
+	if !checkPortAccess(w, r, portIDs...) {
+		return
+	}
+
+	now := time.Now()
+	lease := &PortLease{
+		ID:       newLeaseID(),
+		PortIDs:  portIDs,
+		Owner:    req.Owner,
+		Reason:   req.Reason,
+		Acquired: now,
+		Expires:  now.Add(d),
+	}
+	entry := leaseAudit(requestAudit(r, "lease_acquire"), *lease)
+	if err := portLeases.acquire(lease); err != nil {
+		entry.Result, entry.Details = AuditDenied, entry.Details+": "+err.Error()
+		recordAudit(entry)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	recordAudit(entry)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(lease)
+}
+
+// extendLease extends a lease by the given duration
+func extendLease(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var req struct {
+		Duration string `json:"duration"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	d, err := parseRequestedDuration(req.Duration)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	lease, ok := portLeases.get(id)
+	if !ok {
+		http.Error(w, "Lease not found", http.StatusNotFound)
+		return
+	}
+	entry := leaseAudit(requestAudit(r, "lease_extend"), lease)
+	if !mayManageLease(r, lease) {
+		entry.Result = AuditDenied
+		recordAudit(entry)
+		http.Error(w, "Not the holder of this lease", http.StatusForbidden)
+		return
+	}
+	if lease, ok = portLeases.extend(id, d); !ok {
+		http.Error(w, "Lease not found", http.StatusNotFound)
+		return
+	}
+	recordAudit(leaseAudit(entry, lease))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lease)
+}
+
+// releaseLease ends a lease early
+func releaseLease(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	lease, ok := portLeases.get(id)
+	if !ok {
+		http.Error(w, "Lease not found", http.StatusNotFound)
+		return
+	}
+	entry := leaseAudit(requestAudit(r, "lease_release"), lease)
+	if !mayManageLease(r, lease) {
+		entry.Result = AuditDenied
+		recordAudit(entry)
+		http.Error(w, "Not the holder of this lease", http.StatusForbidden)
+		return
+	}
+	if !portLeases.release(id, "released by "+requestSource(r)) {
+		http.Error(w, "Lease not found", http.StatusNotFound)
+		return
+	}
+	recordAudit(entry)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// leaseAudit fills in the ports and terms of a lease in an audit entry
+func leaseAudit(entry AuditEntry, lease PortLease) AuditEntry {
+	if len(lease.PortIDs) == 1 {
+		entry.PortID = lease.PortIDs[0]
+	}
+	entry.Details = fmt.Sprintf("lease of %s for %s until %s",
+		lease.Owner, strings.Join(lease.PortIDs, ", "), lease.Expires.Format(time.RFC3339))
+	return entry
+}
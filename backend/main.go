@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -11,6 +12,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/gorilla/mux"
@@ -18,18 +20,41 @@ import (
 
 // Config represents the application configuration
 type Config struct {
-	Hubs []HubConfig `toml:"hubs"`
+	Hubs      []HubConfig        `toml:"hubs"`
+	KernelLog KernelLogConfig    `toml:"kernel_log"`
+	Monitor   MonitorConfig      `toml:"monitor"`
+	History   HistoryConfig      `toml:"history"`
+	Snapshots SnapshotConfig     `toml:"snapshots"`
+	Watchdog  []WatchdogConfig   `toml:"watchdog"`
+	Rules     []RuleConfig       `toml:"rules"`
+	Holds     HoldConfig         `toml:"holds"`
+	Scheduler SchedulerConfig    `toml:"scheduler"`
+	Schedules []ScheduleConfig   `toml:"schedules"`
+	Webhooks  []WebhookConfig    `toml:"webhooks"`
+	MQTT      MQTTConfig         `toml:"mqtt"`
+	Auth      AuthConfig         `toml:"auth"`
+	Access    []PortAccessConfig `toml:"access"`
+	Leases    LeaseConfig        `toml:"leases"`
+	Audit     AuditConfig        `toml:"audit"`
+	TLS       TLSConfig          `toml:"tls"`
+	Server    ServerConfig       `toml:"server"`
 }
 
 // HubConfig represents configuration for a specific hub
 type HubConfig struct {
-	VendorID      string         `toml:"vendor_id"`
-	ProductID     string         `toml:"product_id"`
-	Name          string         `toml:"name"`
-	PhysicalPorts int            `toml:"physical_ports"`
-	HiddenPorts   []string       `toml:"hidden_ports"` // Format: "child_index.port"
-	PortMap       map[string]int `toml:"port_map"`     // Maps "child_index.port" -> physical port number
-	GridLayout    [][]int        `toml:"grid_layout"`  // 2D array for visual layout, -1 = empty space
+	VendorID       string         `toml:"vendor_id"`
+	ProductID      string         `toml:"product_id"`
+	Name           string         `toml:"name"`
+	PhysicalPorts  int            `toml:"physical_ports"`
+	HiddenPorts    []string       `toml:"hidden_ports"`    // Format: "child_index.port"
+	PortMap        map[string]int `toml:"port_map"`        // Maps "child_index.port" -> physical port number
+	GridLayout     [][]int        `toml:"grid_layout"`     // 2D array for visual layout, -1 = empty space
+	ProtectedPorts []string       `toml:"protected_ports"` // "child_index.port" of ports scheduled actions never switch off
+	// Power budget
+	SelfPowered  *bool          `toml:"self_powered"`   // Overrides the self-powered bit reported by the hub
+	SupplyMA     int            `toml:"supply_ma"`      // Total current available to downstream ports
+	PortLimitMA  int            `toml:"port_limit_ma"`  // Current limit per downstream port
+	PortLimitsMA map[string]int `toml:"port_limits_ma"` // Per-port limit overrides, keyed by "child_index.port"
 }
 
 var config Config
@@ -44,9 +69,23 @@ type USBDevice struct {
 	Class     string    `json:"class"`
 	Driver    string    `json:"driver"`
 	Speed     string    `json:"speed"`
+	Serial    string    `json:"serial,omitempty"`
 	Ports     []USBPort `json:"ports,omitempty"`
+	// String descriptors, as opposed to Name from the usb.ids database
+	Manufacturer string `json:"manufacturer,omitempty"`
+	Product      string `json:"product,omitempty"`
+	// Power
+	MaxPowerMA  int          `json:"maxPowerMa,omitempty"`  // Configured bMaxPower in mA
+	SelfPowered bool         `json:"selfPowered,omitempty"` // Device reports being self-powered
+	PowerBudget *PowerBudget `json:"powerBudget,omitempty"` // For hubs: available vs used current
+	// Link diagnostics
+	USBVersion string      `json:"usbVersion,omitempty"` // bcdUSB from the device descriptor, e.g. "3.20"
+	Depth      int         `json:"depth,omitempty"`      // Number of tiers below the root hub
+	Issues     []LinkIssue `json:"issues,omitempty"`     // Speed and topology problems detected for this device
 	// For aggregated hubs
 	Aggregated    bool      `json:"aggregated,omitempty"`    // True if this is an aggregated hub
+	HubName       string    `json:"hubName,omitempty"`       // Name to address the hub by, e.g. in port selectors
+	Model         string    `json:"model,omitempty"`         // lsusb name of the hub, as Name becomes "<name> (N ports)"
 	TotalPorts    int       `json:"totalPorts,omitempty"`    // Total ports across all sub-hubs
 	SubHubCount   int       `json:"subHubCount,omitempty"`   // Number of sub-hubs aggregated
 	PhysicalPorts []USBPort `json:"physicalPorts,omitempty"` // All ports from sub-hubs flattened
@@ -63,6 +102,17 @@ type USBPort struct {
 	Location   string `json:"location,omitempty"`   // USB path for uhubctl
 	MappedPort int    `json:"mappedPort,omitempty"` // Physical port number from config mapping
 	PortKey    string `json:"portKey,omitempty"`    // Key used for port mapping (e.g., "1.3")
+	// Kernel-reported over-current and enumeration errors on this port
+	Errors *PortErrorCounters `json:"errors,omitempty"`
+	// Uptime and reconnect counters of the attached device
+	Activity *PortActivity `json:"activity,omitempty"`
+	// Whether the caller may switch this port, and who owns it
+	CanControl *bool    `json:"canControl,omitempty"`
+	Owners     []string `json:"owners,omitempty"`
+	// Active reservation of the port
+	Lease *PortLease `json:"lease,omitempty"`
+	// Power state, if the port was switched through hubcontrol
+	Powered *bool `json:"powered,omitempty"`
 }
 
 // USBBus represents a USB bus (root hub)
@@ -83,6 +133,7 @@ type PowerControlRequest struct {
 	Port     int    `json:"port"`
 	Action   string `json:"action"`             // "on", "off", "cycle"
 	Location string `json:"location,omitempty"` // uhubctl location parameter
+	Lease    string `json:"lease,omitempty"`    // ID of a lease on the port held by the caller
 }
 
 // PowerControlResponse represents the response from power control
@@ -92,30 +143,99 @@ type PowerControlResponse struct {
 }
 
 func main() {
-	// Load configuration
+	// Run as the hubctl command-line client
+	if args, ok := cliArgs(os.Args); ok {
+		os.Exit(runCLI(args))
+	}
+
+	// Load configuration, command-line flags take precedence
+	parseFlags()
 	loadConfig()
+	applyFlags()
+	loadAuth()
+	openAudit()
+	auditConfigLoad()
+
+	// Record port events, then start the sources producing them
+	openHistory()
+	subscribeEvents(portPower.handle)
+	subscribeEvents(countPortEvent)
+	subscribeEvents(broadcastEvent)
+	startActivityTracking()
+	startLeases()
+	startHolds()
+	startKernelLogReader()
+	startTopologyMonitor()
+	startWatchdogs()
+	startRules()
+	startWebhooks()
+	startMQTT()
+	startScheduler()
+	startSnapshots()
 
 	r := mux.NewRouter()
 
 	// API routes
 	api := r.PathPrefix("/api").Subrouter()
 	api.HandleFunc("/topology", getTopology).Methods("GET")
+	api.HandleFunc("/topology/export", exportTopology).Methods("GET")
+	api.HandleFunc("/topology/snapshots", listSnapshots).Methods("GET")
+	api.HandleFunc("/topology/snapshots", createSnapshot).Methods("POST")
+	api.HandleFunc("/topology/snapshots/{id}", getSnapshot).Methods("GET")
+	api.HandleFunc("/topology/diff", getTopologyDiff).Methods("GET")
+	api.HandleFunc("/inventory", getInventory).Methods("GET")
+	api.HandleFunc("/devices", getDevices).Methods("GET")
 	api.HandleFunc("/power", controlPower).Methods("POST")
 	api.HandleFunc("/uhubctl", getUhubctlInfo).Methods("GET")
+	api.HandleFunc("/diagnostics", getDiagnostics).Methods("GET")
+	api.HandleFunc("/kernel/events", getKernelEvents).Methods("GET")
+	api.HandleFunc("/ports/{id}/history", getPortHistory).Methods("GET")
+	api.HandleFunc("/events", streamEvents).Methods("GET")
+	api.HandleFunc("/watchdog", getWatchdogStatus).Methods("GET")
+	api.HandleFunc("/rules", getRules).Methods("GET")
+	api.HandleFunc("/holds/{id}", releaseHold).Methods("DELETE")
+	api.HandleFunc("/webhooks", getWebhooks).Methods("GET")
+	api.HandleFunc("/webhooks/deliveries", getWebhookDeliveries).Methods("GET")
+	api.HandleFunc("/webhooks/{name}/test", testWebhook).Methods("POST")
+	api.HandleFunc("/leases", listLeases).Methods("GET")
+	api.HandleFunc("/leases", acquireLease).Methods("POST")
+	api.HandleFunc("/leases/{id}/extend", extendLease).Methods("POST")
+	api.HandleFunc("/leases/{id}", releaseLease).Methods("DELETE")
+	api.HandleFunc("/schedules", listSchedules).Methods("GET")
+	api.HandleFunc("/schedules", createSchedule).Methods("POST")
+	api.HandleFunc("/schedules/{name}", getSchedule).Methods("GET")
+	api.HandleFunc("/schedules/{name}", updateSchedule).Methods("PUT")
+	api.HandleFunc("/schedules/{name}", deleteSchedule).Methods("DELETE")
+	api.HandleFunc("/schedules/{name}/run", runScheduleNow).Methods("POST")
+	api.HandleFunc("/audit", getAudit).Methods("GET")
+
+	// Prometheus metrics
+	r.HandleFunc("/metrics", getMetrics).Methods("GET")
 
 	// Serve static files for frontend
-	spa := spaHandler{staticPath: "../frontend/dist", indexPath: "index.html"}
+	spa := spaHandler{files: frontendFiles(), indexPath: "index.html"}
 	r.PathPrefix("/").Handler(spa)
 
-	// CORS middleware for development
-	handler := corsMiddleware(r)
+	// Token authentication, and CORS for the configured origins
+	handler := corsMiddleware(authMiddleware(r))
 
-	log.Println("Server starting on :8080")
-	log.Fatal(http.ListenAndServe(":8080", handler))
+	runServer(handler)
 }
 
-// loadConfig loads the configuration from config.toml
+// configPath is the config file that was loaded, empty if the defaults are used
+var configPath string
+
+// loadConfig loads the configuration from the -config file or the first config.toml found
 func loadConfig() {
+	if flags.config != "" {
+		if _, err := toml.DecodeFile(flags.config, &config); err != nil {
+			log.Fatalf("Failed to load config file %s: %v", flags.config, err)
+		}
+		log.Printf("Loaded configuration from %s", flags.config)
+		configPath = flags.config
+		return
+	}
+
 	configPaths := []string{"config.toml", "../config.toml", "/etc/hubcontrol/config.toml"}
 
 	for _, path := range configPaths {
@@ -124,6 +244,7 @@ func loadConfig() {
 				log.Printf("Warning: Failed to parse config file %s: %v", path, err)
 			} else {
 				log.Printf("Loaded configuration from %s", path)
+				configPath = path
 				return
 			}
 		}
@@ -131,6 +252,20 @@ func loadConfig() {
 	log.Println("No config file found, using defaults")
 }
 
+// parseConfigDuration parses an optional positive duration from the config, warning
+// and falling back to def if it is invalid. what names the setting in the warning.
+func parseConfigDuration(what, value string, def time.Duration) time.Duration {
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Printf("Warning: Invalid %s %q, using %s", what, value, def)
+		return def
+	}
+	return d
+}
+
 // getHubConfig returns the configuration for a specific hub, or nil if not configured
 func getHubConfig(vendorID, productID string) *HubConfig {
 	for i := range config.Hubs {
@@ -167,31 +302,6 @@ func getMappedPort(hubConfig *HubConfig, childIndex, portNum int) int {
 	return 0
 }
 
-func corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-
-		next.ServeHTTP(w, r)
-	})
-}
-
-// spaHandler serves the single-page application
-type spaHandler struct {
-	staticPath string
-	indexPath  string
-}
-
-func (h spaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	http.FileServer(http.Dir(h.staticPath)).ServeHTTP(w, r)
-}
-
 // getTopology returns the USB topology by parsing lsusb output
 func getTopology(w http.ResponseWriter, r *http.Request) {
 	topology, err := parseUSBTopology()
@@ -204,13 +314,31 @@ func getTopology(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Query().Get("aggregate") == "true" {
 		topology = aggregateTopology(topology)
 	}
+	annotateTopology(topology)
+	annotatePortAccess(topology, r)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(topology)
 }
 
-// parseUSBTopology parses lsusb -t and lsusb output to build topology
+// annotateTopology attaches runtime port state that isn't part of the lsusb output
+func annotateTopology(topology *USBTopology) {
+	annotateKernelErrors(topology)
+	annotatePortActivity(topology)
+	annotatePortLeases(topology)
+	annotatePortPower(topology)
+}
+
+// parseUSBTopology scans the USB topology and records scan duration and errors
 func parseUSBTopology() (*USBTopology, error) {
+	start := time.Now()
+	topology, err := scanUSBTopology()
+	observeTopologyScan(time.Since(start), err)
+	return topology, err
+}
+
+// scanUSBTopology parses lsusb -t and lsusb output to build topology
+func scanUSBTopology() (*USBTopology, error) {
 	// Get tree structure
 	treeCmd := exec.Command("lsusb", "-t")
 	treeOutput, err := treeCmd.Output()
@@ -231,6 +359,15 @@ func parseUSBTopology() (*USBTopology, error) {
 	// Parse tree structure
 	topology := parseTreeOutput(string(treeOutput), deviceMap)
 
+	// Fill in power attributes and compute hub power budgets
+	enrichFromSysfs(topology)
+	for _, bus := range topology.Buses {
+		applyPowerBudgets(bus.Device)
+	}
+
+	// Flag devices with degraded links or too many hub tiers
+	diagnoseTopology(topology)
+
 	return topology, nil
 }
 
@@ -271,11 +408,11 @@ func parseTreeOutput(output string, deviceMap map[string]DeviceInfo) *USBTopolog
 	seenDevices := make(map[string]bool) // Track seen devices to avoid duplicates
 
 	// Pattern for root hub: /:  Bus 001.Port 001: Dev 001, Class=root_hub, Driver=xhci_hcd/6p, 480M
-	busRe := regexp.MustCompile(`^/:  Bus (\d+)\.Port (\d+): Dev (\d+), Class=([^,]+), Driver=([^,]+), (\d+M?)`)
+	busRe := regexp.MustCompile(`^/:  Bus (\d+)\.Port (\d+): Dev (\d+), Class=([^,]+), Driver=([^,]+), ([\d.]+M?)`)
 
 	// Pattern for device: |__ Port 003: Dev 009, If 0, Class=Hub, Driver=hub/7p, 480M
 	// or:                     |__ Port 003: Dev 009, 480M (no interface info)
-	deviceRe := regexp.MustCompile(`^(\s*)\|__ Port (\d+): Dev (\d+)(?:, If (\d+))?, (?:Class=([^,]+), Driver=([^,]+), )?(\d+M?)`)
+	deviceRe := regexp.MustCompile(`^(\s*)\|__ Port (\d+): Dev (\d+)(?:, If (\d+))?, (?:Class=([^,]+), Driver=([^,]+), )?([\d.]+M?)`)
 
 	for _, line := range lines {
 		if line == "" {
@@ -452,14 +589,22 @@ func aggregateDevice(device *USBDevice, parentPath string) *USBDevice {
 	// If this device is not a hub, just return a copy
 	if len(device.Ports) == 0 {
 		return &USBDevice{
-			Bus:       device.Bus,
-			Device:    device.Device,
-			VendorID:  device.VendorID,
-			ProductID: device.ProductID,
-			Name:      device.Name,
-			Class:     device.Class,
-			Driver:    device.Driver,
-			Speed:     device.Speed,
+			Bus:          device.Bus,
+			Device:       device.Device,
+			VendorID:     device.VendorID,
+			ProductID:    device.ProductID,
+			Name:         device.Name,
+			Class:        device.Class,
+			Driver:       device.Driver,
+			Speed:        device.Speed,
+			Serial:       device.Serial,
+			Manufacturer: device.Manufacturer,
+			Product:      device.Product,
+			MaxPowerMA:   device.MaxPowerMA,
+			SelfPowered:  device.SelfPowered,
+			USBVersion:   device.USBVersion,
+			Depth:        device.Depth,
+			Issues:       device.Issues,
 		}
 	}
 
@@ -522,14 +667,22 @@ func aggregateDevice(device *USBDevice, parentPath string) *USBDevice {
 
 	// Create the result device
 	result := &USBDevice{
-		Bus:       device.Bus,
-		Device:    device.Device,
-		VendorID:  device.VendorID,
-		ProductID: device.ProductID,
-		Name:      device.Name,
-		Class:     device.Class,
-		Driver:    device.Driver,
-		Speed:     device.Speed,
+		Bus:          device.Bus,
+		Device:       device.Device,
+		VendorID:     device.VendorID,
+		ProductID:    device.ProductID,
+		Name:         device.Name,
+		Class:        device.Class,
+		Driver:       device.Driver,
+		Speed:        device.Speed,
+		Serial:       device.Serial,
+		Manufacturer: device.Manufacturer,
+		Product:      device.Product,
+		MaxPowerMA:   device.MaxPowerMA,
+		SelfPowered:  device.SelfPowered,
+		USBVersion:   device.USBVersion,
+		Depth:        device.Depth,
+		Issues:       device.Issues,
 	}
 
 	if subHubCount > 0 {
@@ -592,11 +745,15 @@ func aggregateDevice(device *USBDevice, parentPath string) *USBDevice {
 		}
 
 		result.Aggregated = true
+		result.Model = device.Name
 		result.SubHubCount = subHubCount + 1 // Include self
 		result.TotalPorts = len(aggregatedPorts)
 		result.PhysicalPorts = aggregatedPorts
 		result.Ports = regularPorts // Keep original structure too
 
+		// Budget the aggregated hub as a whole, including its internal child hubs
+		result.PowerBudget = hubPowerBudget(result, hubConfig, aggregatedPorts, internalHubDrawMA(device, device.VendorID))
+
 		// Include grid layout if configured
 		if hubConfig != nil && len(hubConfig.GridLayout) > 0 {
 			result.GridLayout = hubConfig.GridLayout
@@ -608,8 +765,10 @@ func aggregateDevice(device *USBDevice, parentPath string) *USBDevice {
 		} else {
 			result.Name = fmt.Sprintf("%s (%d ports)", device.Name, len(aggregatedPorts))
 		}
+		result.HubName = hubDisplayName(result)
 	} else {
 		result.Ports = regularPorts
+		result.PowerBudget = hubPowerBudget(result, hubConfig, regularPorts, 0)
 	}
 
 	return result
@@ -673,8 +832,7 @@ func collectAllPorts(device *USBDevice, basePath string, vendorID string, hubCon
 
 // getUhubctlInfo returns information from uhubctl
 func getUhubctlInfo(w http.ResponseWriter, r *http.Request) {
-	cmd := exec.Command("sudo", "uhubctl")
-	output, err := cmd.CombinedOutput()
+	output, err := runUhubctl("status")
 
 	response := map[string]interface{}{
 		"available": err == nil,
@@ -693,33 +851,45 @@ func controlPower(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Build uhubctl command
-	args := []string{"uhubctl"}
-
-	if req.Location != "" {
-		args = append(args, "-l", req.Location)
-	}
-
-	args = append(args, "-p", strconv.Itoa(req.Port))
-
-	switch req.Action {
-	case "on":
-		args = append(args, "-a", "on")
-	case "off":
-		args = append(args, "-a", "off")
-	case "cycle":
-		args = append(args, "-a", "cycle")
-	default:
+	if _, ok := powerEventTypes[req.Action]; !ok {
 		http.Error(w, "Invalid action", http.StatusBadRequest)
 		return
 	}
+	portID, err := powerTarget(req.Location, req.Port)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errInvalidPort) {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if !checkPortAccess(w, r, portID) {
+		return
+	}
+	entry := requestAudit(r, "power")
+	entry.PortID, entry.Location, entry.Port, entry.Action = portID, req.Location, req.Port, req.Action
+	leaseID := requestLeaseID(r, portID, req.Lease)
+	if err := checkLease(portID, leaseID); err != nil {
+		entry.Result, entry.Details = AuditDenied, err.Error()
+		recordAudit(entry)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 
-	cmd := exec.Command("sudo", args...)
-	output, err := cmd.CombinedOutput()
+	output, err := switchPortPower(req.Location, req.Port, req.Action, requestSource(r), leaseID)
+	entry.Result, entry.Output = auditResult(err), strings.TrimSpace(output)
+	if err != nil {
+		entry.Details = err.Error()
+	}
+	recordAudit(entry)
+	if err != nil && output == "" {
+		output = err.Error()
+	}
 
 	response := PowerControlResponse{
 		Success: err == nil,
-		Message: string(output),
+		Message: output,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimal Prometheus text exposition for the handful of metrics we export
+
+// metricCounter is a counter vector keyed by label values
+type metricCounter struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+func newCounter(name, help string, labels ...string) *metricCounter {
+	return &metricCounter{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+// inc increments the counter for the given label values
+func (c *metricCounter) inc(labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[strings.Join(labelValues, "\x00")]++
+}
+
+func (c *metricCounter) write(b *strings.Builder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeMetricHeader(b, c.name, c.help, "counter")
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		writeSample(b, c.name, nil, nil, 0)
+		return
+	}
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var values []string
+		if len(c.labels) > 0 {
+			values = strings.Split(k, "\x00")
+		}
+		writeSample(b, c.name, c.labels, values, c.values[k])
+	}
+}
+
+// metricHistogram is a histogram vector with fixed buckets, keyed by label values
+type metricHistogram struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64 // Per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *metricHistogram {
+	return &metricHistogram{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+}
+
+// observe records a value for the given label values
+func (h *metricHistogram) observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := strings.Join(labelValues, "\x00")
+	s := h.series[key]
+	if s == nil {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if value <= upper {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *metricHistogram) write(b *strings.Builder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeMetricHeader(b, h.name, h.help, "histogram")
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := h.series[k]
+		var values []string
+		if len(h.labels) > 0 {
+			values = strings.Split(k, "\x00")
+		}
+		bucketLabels := append(append([]string(nil), h.labels...), "le")
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			le := strconv.FormatFloat(upper, 'g', -1, 64)
+			writeSample(b, h.name+"_bucket", bucketLabels, append(append([]string(nil), values...), le), float64(cumulative))
+		}
+		writeSample(b, h.name+"_bucket", bucketLabels, append(append([]string(nil), values...), "+Inf"), float64(s.count))
+		writeSample(b, h.name+"_sum", h.labels, values, s.sum)
+		writeSample(b, h.name+"_count", h.labels, values, float64(s.count))
+	}
+}
+
+func writeMetricHeader(b *strings.Builder, name, help, kind string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeSample(b *strings.Builder, name string, labels, values []string, value float64) {
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteString("{")
+		for i, label := range labels {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			fmt.Fprintf(b, `%s="%s"`, label, labelEscaper.Replace(values[i]))
+		}
+		b.WriteString("}")
+	}
+	fmt.Fprintf(b, " %s\n", strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// gaugeSample is a single gauge value computed at scrape time
+type gaugeSample struct {
+	values []string
+	value  float64
+}
+
+func writeGauge(b *strings.Builder, name, help string, labels []string, samples []gaugeSample) {
+	writeMetricHeader(b, name, help, "gauge")
+	for _, s := range samples {
+		writeSample(b, name, labels, s.values, s.value)
+	}
+}
+
+var durationBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	topologyScanDuration = newHistogram("hubcontrol_topology_scan_duration_seconds", "Time taken to scan the USB topology.", durationBuckets)
+	topologyScanErrors   = newCounter("hubcontrol_topology_scan_errors_total", "Topology scans that failed.")
+	uhubctlDuration      = newHistogram("hubcontrol_uhubctl_duration_seconds", "Time taken by uhubctl invocations.", durationBuckets, "kind")
+	powerActions         = newCounter("hubcontrol_power_actions_total", "Port power actions by action and result.", "action", "result")
+	portEvents           = newCounter("hubcontrol_port_events_total", "Port events (attach, detach, power, kernel errors) per port.", "port_id", "hub", "hub_id", "mapped_port", "type")
+)
+
+// observeTopologyScan records the duration and outcome of a topology scan
+func observeTopologyScan(d time.Duration, err error) {
+	topologyScanDuration.observe(d.Seconds())
+	if err != nil {
+		topologyScanErrors.inc()
+	}
+}
+
+// observeUhubctl records how long a uhubctl invocation took
+func observeUhubctl(kind string, d time.Duration) {
+	uhubctlDuration.observe(d.Seconds(), kind)
+}
+
+// observePowerAction counts a power action by its result
+func observePowerAction(action string, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	powerActions.inc(action, result)
+}
+
+// countPortEvent counts port events for the per-port attach/detach counters
+func countPortEvent(event PortEvent) {
+	mapped := ""
+	if event.MappedPort > 0 {
+		mapped = strconv.Itoa(event.MappedPort)
+	}
+	hubID, hub := "", event.HubName
+	if _, aggregated := monitor.snapshot(); aggregated != nil {
+		if id, name, ok := portHub(aggregated, event.PortID); ok {
+			hubID, hub = id, name
+		}
+	}
+	portEvents.inc(event.PortID, hub, hubID, mapped, event.Type)
+}
+
+// portHub returns the sysfs ID and display name of the hub a port belongs to in an
+// aggregated topology, the hub_id and hub labels of the hub and port metrics
+func portHub(aggregated *USBTopology, portID string) (id, name string, ok bool) {
+	walkDevices(aggregated, func(bus int, path string, depth int, device *USBDevice) {
+		walkDevicePorts(device, bus, path, func(portPath string, port *USBPort) {
+			if sysfsName(bus, portPath) == portID {
+				id, name, ok = sysfsName(bus, path), hubDisplayName(device), true
+			}
+		})
+	})
+	return id, name, ok
+}
+
+// writeTopologyGauges exports the state of the last monitor scan
+func writeTopologyGauges(b *strings.Builder) {
+	raw, aggregated := monitor.snapshot()
+	if raw == nil {
+		return
+	}
+
+	var busDevices []gaugeSample
+	for _, bus := range raw.Buses {
+		count := 0
+		walkDevices(&USBTopology{Buses: []USBBus{bus}}, func(busNum int, path string, depth int, device *USBDevice) {
+			if depth > 0 {
+				count++
+			}
+		})
+		busDevices = append(busDevices, gaugeSample{[]string{strconv.Itoa(bus.Bus)}, float64(count)})
+	}
+	writeGauge(b, "hubcontrol_bus_devices", "Devices connected to a USB bus, including hubs.", []string{"bus"}, busDevices)
+
+	var hubDevices, hubUsed, hubAvailable, portPresent, portPowered []gaugeSample
+	walkDevices(aggregated, func(bus int, path string, depth int, device *USBDevice) {
+		if len(device.Ports) == 0 && len(device.PhysicalPorts) == 0 {
+			return
+		}
+		hubID := sysfsName(bus, path)
+		name := hubDisplayName(device)
+		hubLabels := []string{name, hubID}
+
+		count := 0
+		walkDevicePorts(device, bus, path, func(portPath string, port *USBPort) {
+			present := 0.0
+			if port.Device != nil {
+				count++
+				present = 1
+			}
+			portID := sysfsName(bus, portPath)
+			mapped := ""
+			if port.MappedPort > 0 {
+				mapped = strconv.Itoa(port.MappedPort)
+			}
+			portLabels := []string{portID, name, hubID, mapped, port.PortKey}
+			portPresent = append(portPresent, gaugeSample{portLabels, present})
+
+			// Only ports whose state is known; unknown ports are not assumed to be on
+			if on, known := portPower.powered(portID); known {
+				powered := 0.0
+				if on {
+					powered = 1
+				}
+				portPowered = append(portPowered, gaugeSample{portLabels, powered})
+			}
+		})
+		hubDevices = append(hubDevices, gaugeSample{hubLabels, float64(count)})
+
+		if device.PowerBudget != nil {
+			hubUsed = append(hubUsed, gaugeSample{hubLabels, float64(device.PowerBudget.UsedMA)})
+			hubAvailable = append(hubAvailable, gaugeSample{hubLabels, float64(device.PowerBudget.AvailableMA)})
+		}
+	})
+
+	// hub is the display name and hub_id the sysfs ID of the hub on all hub and port metrics
+	hubLabelNames := []string{"hub", "hub_id"}
+	portLabelNames := []string{"port_id", "hub", "hub_id", "mapped_port", "port_key"}
+	writeGauge(b, "hubcontrol_hub_devices", "Devices attached directly to a hub (aggregated hubs count all their ports).", hubLabelNames, hubDevices)
+	writeGauge(b, "hubcontrol_hub_power_used_milliamps", "Sum of bMaxPower of devices attached to a hub.", hubLabelNames, hubUsed)
+	writeGauge(b, "hubcontrol_hub_power_available_milliamps", "Current a hub can supply downstream.", hubLabelNames, hubAvailable)
+	writeGauge(b, "hubcontrol_port_device_present", "Whether a device is attached to a port.", portLabelNames, portPresent)
+	writeGauge(b, "hubcontrol_port_powered", "Whether a port is powered, as read from uhubctl at startup or switched through hubcontrol since; ports uhubctl doesn't list are not.", portLabelNames, portPowered)
+
+	scanned := monitor.lastScan()
+	writeGauge(b, "hubcontrol_last_scan_timestamp_seconds", "Unix time of the last successful topology scan.", nil, []gaugeSample{{nil, float64(scanned.UnixNano()) / 1e9}})
+}
+
+// getMetrics serves metrics in the Prometheus text format
+func getMetrics(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	writeTopologyGauges(&b)
+	portEvents.write(&b)
+	powerActions.write(&b)
+	webhookResults.write(&b)
+	uhubctlDuration.write(&b)
+	topologyScanDuration.write(&b)
+	topologyScanErrors.write(&b)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// MonitorConfig configures periodic topology scanning for hotplug events
+type MonitorConfig struct {
+	Interval      string `toml:"interval"`       // Scan interval, e.g. "2s"
+	FlapThreshold int    `toml:"flap_threshold"` // Reconnects per hour that mark a port as flapping
+}
+
+const defaultMonitorInterval = 2 * time.Second
+
+// portState is the device seen on a port during a scan
+type portState struct {
+	Device    int
+	VendorID  string
+	ProductID string
+	Name      string
+	Class     string
+	Serial    string
+}
+
+// topologyMonitor periodically scans the topology and publishes attach/detach events
+type topologyMonitor struct {
+	mu         sync.RWMutex
+	raw        *USBTopology
+	aggregated *USBTopology
+	refs       map[string]portRef
+	ports      map[string]portState
+	scanned    time.Time
+}
+
+var monitor = &topologyMonitor{}
+
+// startTopologyMonitor scans the topology in the background at the configured interval
+func startTopologyMonitor() {
+	interval := parseConfigDuration("monitor interval", config.Monitor.Interval, defaultMonitorInterval)
+
+	go func() {
+		failing := false
+		for {
+			if err := monitor.scan(); err != nil {
+				// Only log the first of a series of failures
+				if !failing {
+					log.Printf("Warning: Topology scan failed: %v", err)
+				}
+				failing = true
+			} else {
+				failing = false
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// scan refreshes the topology and publishes events for devices that came or went.
+// The first scan only records the initial state.
+func (m *topologyMonitor) scan() error {
+	raw, err := parseUSBTopology()
+	if err != nil {
+		return err
+	}
+	aggregated := aggregateTopology(raw)
+
+	ports := make(map[string]portState)
+	walkPorts(raw, func(bus int, path string, port *USBPort) {
+		if port.Device != nil {
+			ports[sysfsName(bus, path)] = portState{
+				Device:    port.Device.Device,
+				VendorID:  port.Device.VendorID,
+				ProductID: port.Device.ProductID,
+				Name:      port.Device.Name,
+				Class:     port.Device.Class,
+				Serial:    port.Device.Serial,
+			}
+		}
+	})
+
+	m.mu.Lock()
+	previous := m.ports
+	m.raw = raw
+	m.aggregated = aggregated
+	m.refs = buildPortRefs(aggregated)
+	m.ports = ports
+	m.scanned = time.Now()
+	m.mu.Unlock()
+
+	if previous == nil {
+		portPower.seed()
+		return nil
+	}
+
+	// Detach first so a re-enumerated device shows as detach followed by attach
+	for id, old := range previous {
+		if cur, ok := ports[id]; !ok || cur.Device != old.Device {
+			publishEvent(portStateEvent(EventDetach, id, old))
+		}
+	}
+	for id, cur := range ports {
+		if old, ok := previous[id]; !ok || cur.Device != old.Device {
+			publishEvent(portStateEvent(EventAttach, id, cur))
+		}
+	}
+	return nil
+}
+
+// portStateEvent builds an attach or detach event for a port
+func portStateEvent(eventType, portID string, state portState) PortEvent {
+	bus, path, _ := splitPortID(portID)
+	return PortEvent{
+		Type:       eventType,
+		PortID:     portID,
+		Bus:        bus,
+		Location:   path,
+		VendorID:   state.VendorID,
+		ProductID:  state.ProductID,
+		DeviceName: state.Name,
+		Class:      state.Class,
+		Serial:     state.Serial,
+	}
+}
+
+// portRef returns the aggregated hub attribution of a port from the last scan
+func (m *topologyMonitor) portRef(portID string) (portRef, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ref, ok := m.refs[portID]
+	return ref, ok
+}
+
+// snapshot returns the raw and aggregated topology of the last successful scan,
+// or nil if no scan has succeeded yet
+func (m *topologyMonitor) snapshot() (raw, aggregated *USBTopology) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.raw, m.aggregated
+}
+
+// lastScan returns the time of the last successful scan
+func (m *topologyMonitor) lastScan() time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.scanned
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTTConfig configures publishing port state to an MQTT broker and receiving power commands
+type MQTTConfig struct {
+	Broker          string `toml:"broker"`    // e.g. "tcp://localhost:1883"; MQTT is disabled if empty
+	ClientID        string `toml:"client_id"` // Default "hubcontrol-<hostname>"
+	Username        string `toml:"username"`
+	Password        string `toml:"password"`
+	TopicPrefix     string `toml:"topic_prefix"`     // Default "hubcontrol"
+	QoS             int    `toml:"qos"`              // 0, 1 or 2
+	DisableCommands bool   `toml:"disable_commands"` // Don't subscribe to <port>/set topics
+	Identity        string `toml:"identity"`         // Token name whose port access commands get; unrestricted if empty
+	Discovery       bool   `toml:"discovery"`        // Announce ports through Home Assistant MQTT discovery
+	DiscoveryPrefix string `toml:"discovery_prefix"` // Default "homeassistant"
+}
+
+const (
+	defaultMQTTTopicPrefix = "hubcontrol"
+	defaultDiscoveryPrefix = "homeassistant"
+	mqttResyncInterval     = 30 * time.Second
+	mqttPublishTimeout     = 5 * time.Second
+)
+
+// mqttPort is the state of a port as published to <topic>/state
+type mqttPort struct {
+	Topic      string `json:"-"` // Base topic of the port
+	PortID     string `json:"portId"`
+	Hub        string `json:"hub,omitempty"`
+	HubModel   string `json:"-"` // lsusb name of the hub
+	MappedPort int    `json:"mappedPort,omitempty"`
+	PortKey    string `json:"portKey,omitempty"`
+	Present    bool   `json:"present"`
+	Device     string `json:"device,omitempty"` // VID:PID
+	DeviceName string `json:"deviceName,omitempty"`
+	Serial     string `json:"serial,omitempty"`
+	Power      string `json:"power"` // "on", "off" or "unknown"
+}
+
+// mqttBridge publishes retained port state and handles command topics
+type mqttBridge struct {
+	client          mqtt.Client
+	prefix          string
+	qos             byte
+	commands        bool   // Subscribed to command topics
+	identity        string // Token name commands act as, empty for no access checks
+	discoveryPrefix string // Home Assistant discovery prefix, empty if disabled
+
+	mu        sync.Mutex
+	published map[string]string // Topic -> last published payload
+	portIDs   map[string]string // Base topic -> port ID, for command topics
+
+	wake chan struct{}
+}
+
+var mqttClient *mqttBridge
+
+var mqttTopicUnsafe = regexp.MustCompile(`[^a-z0-9_-]+`)
+
+// mqttTopicName turns a hub name into a topic level, e.g. "Test Hub" gives "test_hub"
+func mqttTopicName(name string) string {
+	return strings.Trim(mqttTopicUnsafe.ReplaceAllString(strings.ToLower(name), "_"), "_")
+}
+
+// startMQTT connects to the configured broker and starts publishing port state
+func startMQTT() {
+	cfg := config.MQTT
+	if cfg.Broker == "" {
+		return
+	}
+
+	prefix := strings.TrimSuffix(cfg.TopicPrefix, "/")
+	if prefix == "" {
+		prefix = defaultMQTTTopicPrefix
+	}
+	clientID := cfg.ClientID
+	if clientID == "" {
+		hostname, _ := os.Hostname()
+		clientID = "hubcontrol-" + hostname
+	}
+	if cfg.QoS < 0 || cfg.QoS > 2 {
+		log.Printf("Warning: Invalid MQTT qos %d, using 0", cfg.QoS)
+		cfg.QoS = 0
+	}
+
+	b := &mqttBridge{
+		prefix:    prefix,
+		qos:       byte(cfg.QoS),
+		commands:  !cfg.DisableCommands,
+		identity:  cfg.Identity,
+		published: make(map[string]string),
+		portIDs:   make(map[string]string),
+		wake:      make(chan struct{}, 1),
+	}
+	if b.identity != "" {
+		if _, ok := tokenAccess(b.identity); !ok {
+			log.Printf("Warning: MQTT identity %q is not a configured token, commands will be refused", b.identity)
+		}
+	}
+	if cfg.Discovery {
+		b.discoveryPrefix = strings.TrimSuffix(cfg.DiscoveryPrefix, "/")
+		if b.discoveryPrefix == "" {
+			b.discoveryPrefix = defaultDiscoveryPrefix
+		}
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(clientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetWill(prefix+"/status", "offline", b.qos, true).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("Warning: MQTT connection lost: %v", err)
+		}).
+		SetOnConnectHandler(func(c mqtt.Client) {
+			log.Printf("Connected to MQTT broker %s", cfg.Broker)
+			b.onConnect(c)
+		})
+	b.client = mqtt.NewClient(opts)
+	mqttClient = b
+
+	// With connect retry the token only completes once connected, don't wait for it
+	b.client.Connect()
+
+	subscribeEvents(func(PortEvent) { b.trigger() })
+	go b.loop()
+}
+
+// onConnect announces availability, subscribes to commands and republishes everything,
+// since retained messages may have been lost while disconnected
+func (b *mqttBridge) onConnect(c mqtt.Client) {
+	c.Publish(b.prefix+"/status", b.qos, true, "online")
+	if b.commands {
+		c.Subscribe(b.prefix+"/+/+/set", b.qos, b.handleCommand)
+	}
+	if b.discoveryPrefix != "" {
+		// Home Assistant announces restarts, after which discovery configs must be sent again
+		c.Subscribe(b.discoveryPrefix+"/status", b.qos, func(_ mqtt.Client, msg mqtt.Message) {
+			if string(msg.Payload()) == "online" {
+				b.resync()
+			}
+		})
+	}
+	b.resync()
+}
+
+// resync forgets what was published so that everything is published again
+func (b *mqttBridge) resync() {
+	b.mu.Lock()
+	b.published = make(map[string]string)
+	b.mu.Unlock()
+	b.trigger()
+}
+
+// trigger schedules a publish of changed port state
+func (b *mqttBridge) trigger() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// loop publishes port state whenever something changed, and periodically as a safety net
+func (b *mqttBridge) loop() {
+	for {
+		if b.client.IsConnectionOpen() {
+			if _, aggregated := monitor.snapshot(); aggregated != nil {
+				ports := mqttPorts(aggregated, b.prefix)
+				if b.discoveryPrefix == "" || b.publishDiscovery(ports) {
+					b.publishPorts(ports)
+				}
+			}
+		}
+		select {
+		case <-b.wake:
+		case <-time.After(mqttResyncInterval):
+		}
+	}
+}
+
+// mqttPorts lists all ports of a topology with their state and base topic. Ports of
+// aggregated hubs are keyed by hub name and mapped port (or PortKey), other ports
+// by port ID under <prefix>/ports.
+func mqttPorts(aggregated *USBTopology, prefix string) []mqttPort {
+	var ports []mqttPort
+	walkDevices(aggregated, func(bus int, path string, depth int, device *USBDevice) {
+		walkDevicePorts(device, bus, path, func(portPath string, port *USBPort) {
+			p := mqttPort{
+				PortID:     sysfsName(bus, portPath),
+				MappedPort: port.MappedPort,
+				PortKey:    port.PortKey,
+			}
+			switch {
+			case device.Aggregated && port.MappedPort > 0:
+				p.Hub = hubDisplayName(device)
+				p.HubModel = device.Model
+				p.Topic = fmt.Sprintf("%s/%s/%d", prefix, mqttTopicName(p.Hub), port.MappedPort)
+			case device.Aggregated && port.PortKey != "":
+				p.Hub = hubDisplayName(device)
+				p.HubModel = device.Model
+				p.Topic = fmt.Sprintf("%s/%s/%s", prefix, mqttTopicName(p.Hub), port.PortKey)
+			default:
+				p.Topic = fmt.Sprintf("%s/ports/%s", prefix, p.PortID)
+			}
+
+			if port.Device != nil {
+				p.Present = true
+				p.Device = port.Device.VendorID + ":" + port.Device.ProductID
+				p.DeviceName = port.Device.Name
+				p.Serial = port.Device.Serial
+			}
+
+			p.Power = "unknown"
+			if powered, known := portPower.powered(p.PortID); known && powered {
+				p.Power = "on"
+			} else if known {
+				p.Power = "off"
+			} else if p.Present {
+				// A device can only be there if the port has power
+				p.Power = "on"
+			}
+			ports = append(ports, p)
+		})
+	})
+	return ports
+}
+
+// publishPorts publishes the retained state topics of all ports that changed,
+// stopping at the first failure; the rest is retried on the next pass
+func (b *mqttBridge) publishPorts(ports []mqttPort) {
+	portIDs := make(map[string]string, len(ports))
+	for _, p := range ports {
+		portIDs[p.Topic] = p.PortID
+	}
+	b.mu.Lock()
+	b.portIDs = portIDs
+	b.mu.Unlock()
+
+	for _, p := range ports {
+		state, _ := json.Marshal(p)
+		ok := b.publish(p.Topic+"/state", string(state)) &&
+			b.publish(p.Topic+"/present", strconv.FormatBool(p.Present)) &&
+			b.publish(p.Topic+"/device", p.Device) &&
+			b.publish(p.Topic+"/name", p.DeviceName) &&
+			b.publish(p.Topic+"/power", p.Power)
+		if !ok {
+			return
+		}
+	}
+}
+
+// publish sends a retained message unless the same payload was already published
+func (b *mqttBridge) publish(topic, payload string) bool {
+	b.mu.Lock()
+	if last, ok := b.published[topic]; ok && last == payload {
+		b.mu.Unlock()
+		return true
+	}
+	b.mu.Unlock()
+
+	token := b.client.Publish(topic, b.qos, true, payload)
+	if !token.WaitTimeout(mqttPublishTimeout) {
+		log.Printf("Warning: MQTT publish to %s timed out", topic)
+		return false
+	}
+	if err := token.Error(); err != nil {
+		log.Printf("Warning: MQTT publish to %s failed: %v", topic, err)
+		return false
+	}
+
+	b.mu.Lock()
+	b.published[topic] = payload
+	b.mu.Unlock()
+	return true
+}
+
+// handleCommand switches a port on a message to <port topic>/set with payload
+// "on", "off" or "cycle"
+func (b *mqttBridge) handleCommand(_ mqtt.Client, msg mqtt.Message) {
+	base := strings.TrimSuffix(msg.Topic(), "/set")
+	action := strings.ToLower(strings.TrimSpace(string(msg.Payload())))
+
+	b.mu.Lock()
+	portID, ok := b.portIDs[base]
+	b.mu.Unlock()
+	if !ok {
+		log.Printf("Warning: MQTT command on unknown port topic %s", msg.Topic())
+		return
+	}
+	if _, ok := powerEventTypes[action]; !ok {
+		log.Printf("Warning: MQTT command %q on %s is not on, off or cycle", action, msg.Topic())
+		return
+	}
+	location, port, ok := uhubctlTarget(portID)
+	if !ok {
+		log.Printf("Warning: MQTT command on %s: cannot power control port %s", msg.Topic(), portID)
+		return
+	}
+
+	source := "mqtt"
+	if b.identity != "" {
+		source = "mqtt:" + b.identity
+		if access, ok := tokenAccess(b.identity); !ok || !access.canControl(portID) {
+			log.Printf("Warning: Rejected MQTT command %s on %s: %s may not control port %s", action, msg.Topic(), b.identity, portID)
+			recordAudit(AuditEntry{Actor: source, Operation: "access", PortID: portID, Action: action, Result: AuditDenied, Details: "mqtt " + msg.Topic()})
+			return
+		}
+	}
+
+	// Don't block the client's message handling while uhubctl runs
+	go func() {
+		if output, err := setPortPower(location, port, action, source); err != nil {
+			log.Printf("MQTT command %s on %s failed: %v: %s", action, portID, err, strings.TrimSpace(output))
+		}
+	}()
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// portRef identifies a port within an aggregated hub
+type portRef struct {
+	PortKey    string
+	MappedPort int
+	HubName    string
+}
+
+// hubDisplayName returns the configured name of a hub, or its lsusb name
+func hubDisplayName(device *USBDevice) string {
+	if device.HubName != "" {
+		return device.HubName
+	}
+	if hubConfig := getHubConfig(device.VendorID, device.ProductID); hubConfig != nil && hubConfig.Name != "" {
+		return hubConfig.Name
+	}
+	return device.Name
+}
+
+// gridCell is a port as placed in a hub's grid
+type gridCell struct {
+	PortID string
+	Label  string // Mapped port, port key or port number
+	Port   *USBPort
+}
+
+// hubGrid arranges the ports of a hub in rows, nil for a gap. Aggregated hubs
+// follow their grid_layout of mapped ports (-1 for a gap); ports without a place
+// follow in extra rows of up to rowLen ports, ordered by mapped port.
+func hubGrid(device *USBDevice, bus int, path string, rowLen int) [][]*gridCell {
+	var cells []*gridCell
+	byMapped := make(map[int]*gridCell)
+	walkDevicePorts(device, bus, path, func(portPath string, port *USBPort) {
+		cell := &gridCell{PortID: sysfsName(bus, portPath), Label: strconv.Itoa(port.Port), Port: port}
+		if device.Aggregated {
+			if port.MappedPort > 0 {
+				cell.Label = strconv.Itoa(port.MappedPort)
+				byMapped[port.MappedPort] = cell
+			} else if port.PortKey != "" {
+				cell.Label = port.PortKey
+			}
+		}
+		cells = append(cells, cell)
+	})
+
+	var rows [][]*gridCell
+	placed := make(map[*gridCell]bool)
+	if device.Aggregated {
+		for _, layoutRow := range device.GridLayout {
+			row := make([]*gridCell, len(layoutRow))
+			for i, mapped := range layoutRow {
+				if cell, ok := byMapped[mapped]; ok && mapped > 0 {
+					row[i] = cell
+					placed[cell] = true
+				}
+			}
+			rows = append(rows, row)
+		}
+	}
+
+	var rest []*gridCell
+	for _, cell := range cells {
+		if !placed[cell] {
+			rest = append(rest, cell)
+		}
+	}
+	sort.SliceStable(rest, func(i, j int) bool {
+		a, b := rest[i].Port.MappedPort, rest[j].Port.MappedPort
+		return a > 0 && (b == 0 || a < b)
+	})
+	for len(rest) > 0 {
+		n := rowLen
+		if n > len(rest) {
+			n = len(rest)
+		}
+		rows = append(rows, rest[:n])
+		rest = rest[n:]
+	}
+	return rows
+}
+
+// buildPortRefs maps port IDs to their aggregated hub name, PortKey and mapped port
+func buildPortRefs(aggregated *USBTopology) map[string]portRef {
+	refs := make(map[string]portRef)
+	walkDevices(aggregated, func(bus int, path string, depth int, device *USBDevice) {
+		walkDevicePorts(device, bus, path, func(portPath string, port *USBPort) {
+			ref := portRef{PortKey: port.PortKey, MappedPort: port.MappedPort}
+			if device.Aggregated {
+				ref.HubName = hubDisplayName(device)
+			}
+			refs[sysfsName(bus, portPath)] = ref
+		})
+	})
+	return refs
+}
+
+// protectedPortIDs returns the port IDs of ports listed in a hub's protected_ports,
+// which scheduled actions never switch off
+func protectedPortIDs(aggregated *USBTopology) map[string]bool {
+	protected := make(map[string]bool)
+	walkDevices(aggregated, func(bus int, path string, depth int, device *USBDevice) {
+		hubConfig := getHubConfig(device.VendorID, device.ProductID)
+		if hubConfig == nil || len(hubConfig.ProtectedPorts) == 0 {
+			return
+		}
+		walkDevicePorts(device, bus, path, func(portPath string, port *USBPort) {
+			for _, key := range hubConfig.ProtectedPorts {
+				if port.PortKey != "" && port.PortKey == key {
+					protected[sysfsName(bus, portPath)] = true
+				}
+			}
+		})
+	})
+	return protected
+}
+
+// powerPortID returns the port ID for a uhubctl hub location and port number,
+// e.g. "1-3.1" and 2 give "1-3.1.2", "1" and 2 give "1-2"
+func powerPortID(location string, port int) string {
+	if location == "" {
+		return ""
+	}
+	if !strings.Contains(location, "-") {
+		return fmt.Sprintf("%s-%d", location, port)
+	}
+	return fmt.Sprintf("%s.%d", location, port)
+}
+
+// splitPortID splits a port ID like "1-3.2" into the bus and USB path
+func splitPortID(portID string) (int, string, bool) {
+	parts := strings.SplitN(portID, "-", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return 0, "", false
+	}
+	var bus int
+	if _, err := fmt.Sscanf(parts[0], "%d", &bus); err != nil {
+		return 0, "", false
+	}
+	return bus, parts[1], true
+}
+
+// uhubctlTarget returns the uhubctl hub location and port number of a port ID,
+// e.g. "1-3.1.2" gives "1-3.1" and 2, "1-3" gives "1" and 3
+func uhubctlTarget(portID string) (string, int, bool) {
+	bus, path, ok := splitPortID(portID)
+	if !ok {
+		return "", 0, false
+	}
+	hubPath, portStr := "", path
+	if idx := strings.LastIndex(path, "."); idx >= 0 {
+		hubPath, portStr = path[:idx], path[idx+1:]
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, false
+	}
+	if hubPath == "" {
+		return strconv.Itoa(bus), port, true
+	}
+	return fmt.Sprintf("%d-%s", bus, hubPath), port, true
+}
+
+// PortSelector addresses a port either by aggregated hub name plus mapped port or
+// PortKey, or directly by port ID
+type PortSelector struct {
+	Hub        string `toml:"hub" json:"hub,omitempty"`                // Configured (or lsusb) name of the aggregated hub
+	MappedPort int    `toml:"mapped_port" json:"mappedPort,omitempty"` // Physical port number on that hub
+	PortKey    string `toml:"port_key" json:"portKey,omitempty"`       // "child_index.port" on that hub
+	PortID     string `toml:"port_id" json:"portId,omitempty"`         // Kernel port path, e.g. "1-3.1.2"
+}
+
+// String returns a human readable form of the selector
+func (s PortSelector) String() string {
+	switch {
+	case s.PortID != "":
+		return s.PortID
+	case s.MappedPort > 0:
+		return fmt.Sprintf("%s port %d", s.Hub, s.MappedPort)
+	default:
+		return fmt.Sprintf("%s port %s", s.Hub, s.PortKey)
+	}
+}
+
+// resolvePort finds the port ID a selector refers to in an aggregated topology
+func resolvePort(aggregated *USBTopology, sel PortSelector) (string, error) {
+	if sel.PortID != "" {
+		if _, _, ok := splitPortID(sel.PortID); !ok {
+			return "", fmt.Errorf("invalid port ID %q", sel.PortID)
+		}
+		return sel.PortID, nil
+	}
+	if sel.MappedPort == 0 && sel.PortKey == "" {
+		return "", fmt.Errorf("port selector needs a port ID, mapped port or port key")
+	}
+
+	var found []string
+	walkDevices(aggregated, func(bus int, path string, depth int, device *USBDevice) {
+		if sel.Hub != "" && !strings.EqualFold(hubDisplayName(device), sel.Hub) {
+			return
+		}
+		walkDevicePorts(device, bus, path, func(portPath string, port *USBPort) {
+			if (sel.MappedPort > 0 && port.MappedPort == sel.MappedPort) ||
+				(sel.PortKey != "" && port.PortKey == sel.PortKey) {
+				found = append(found, sysfsName(bus, portPath))
+			}
+		})
+	})
+
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no port matches %s", sel)
+	case 1:
+		return found[0], nil
+	default:
+		return "", fmt.Errorf("%s is ambiguous, matches %s", sel, strings.Join(found, ", "))
+	}
+}
+
+// PortSet selects several ports: all ports of Hub, or the listed mapped ports and
+// port keys on Hub, plus any listed port IDs
+type PortSet struct {
+	Hub         string   `toml:"hub" json:"hub,omitempty"`
+	MappedPorts []int    `toml:"mapped_ports" json:"mappedPorts,omitempty"`
+	PortKeys    []string `toml:"port_keys" json:"portKeys,omitempty"`
+	PortIDs     []string `toml:"port_ids" json:"portIds,omitempty"`
+}
+
+// resolvePortSet returns the port IDs of a port set in an aggregated topology
+func resolvePortSet(aggregated *USBTopology, set PortSet) ([]string, error) {
+	for _, portID := range set.PortIDs {
+		if !topologyHasPort(aggregated, portID) {
+			return nil, fmt.Errorf("port %s not found", portID)
+		}
+	}
+	targets := append([]string(nil), set.PortIDs...)
+	if set.Hub == "" {
+		return targets, nil
+	}
+
+	if len(set.MappedPorts) == 0 && len(set.PortKeys) == 0 {
+		found := false
+		walkDevices(aggregated, func(bus int, path string, depth int, device *USBDevice) {
+			if !device.Aggregated || !strings.EqualFold(hubDisplayName(device), set.Hub) {
+				return
+			}
+			found = true
+			walkDevicePorts(device, bus, path, func(portPath string, port *USBPort) {
+				targets = append(targets, sysfsName(bus, portPath))
+			})
+		})
+		if !found {
+			return nil, fmt.Errorf("hub %q not found", set.Hub)
+		}
+		return targets, nil
+	}
+
+	for _, mapped := range set.MappedPorts {
+		id, err := resolvePort(aggregated, PortSelector{Hub: set.Hub, MappedPort: mapped})
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, id)
+	}
+	for _, key := range set.PortKeys {
+		id, err := resolvePort(aggregated, PortSelector{Hub: set.Hub, PortKey: key})
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, id)
+	}
+	return targets, nil
+}
+
+// findPortDevice returns the device attached to a port in a topology, or nil
+func findPortDevice(topology *USBTopology, portID string) *USBDevice {
+	var device *USBDevice
+	walkPorts(topology, func(bus int, path string, port *USBPort) {
+		if port.Device != nil && sysfsName(bus, path) == portID {
+			device = port.Device
+		}
+	})
+	return device
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// powerEventTypes maps uhubctl actions to the event recorded on success
+var powerEventTypes = map[string]string{
+	"on":    EventPowerOn,
+	"off":   EventPowerOff,
+	"cycle": EventPowerCycle,
+}
+
+// errInvalidPort is returned for power requests that don't name an existing port
+var errInvalidPort = errors.New("invalid port")
+
+// powerTarget returns the port ID of a uhubctl hub location and port number if
+// the port exists in the current topology. Without a location uhubctl would
+// switch that port number on every hub.
+func powerTarget(location string, port int) (string, error) {
+	if location == "" || port <= 0 {
+		return "", fmt.Errorf("%w: location and port are required", errInvalidPort)
+	}
+	portID := powerPortID(location, port)
+	// The last scan may not know a hub that was just plugged in
+	if raw, _ := monitor.snapshot(); raw != nil && topologyHasPort(raw, portID) {
+		return portID, nil
+	}
+	raw, err := parseUSBTopology()
+	if err != nil {
+		return "", err
+	}
+	if !topologyHasPort(raw, portID) {
+		return "", fmt.Errorf("%w: port %s not found", errInvalidPort, portID)
+	}
+	return portID, nil
+}
+
+// topologyHasPort reports whether a raw topology has a port
+func topologyHasPort(raw *USBTopology, portID string) bool {
+	found := false
+	walkPorts(raw, func(bus int, path string, port *USBPort) {
+		if sysfsName(bus, path) == portID {
+			found = true
+		}
+	})
+	return found
+}
+
+// setPortPower switches power on a hub port with uhubctl, publishes the result
+// as an event and records it in the audit log. location is the uhubctl hub
+// location (e.g. "1-3.1"), source describes who asked for it.
+func setPortPower(location string, port int, action, source string) (string, error) {
+	return setLeasedPortPower(location, port, action, source, "")
+}
+
+// setLeasedPortPower is setPortPower acting under a lease, whose owner is noted in
+// the audit log
+func setLeasedPortPower(location string, port int, action, source, leaseID string) (string, error) {
+	var holder string
+	if lease, ok := portLeases.get(leaseID); ok && leaseID != "" {
+		holder = "lease of " + lease.Owner
+	}
+	output, err := switchPortPower(location, port, action, source, leaseID)
+	entry := AuditEntry{
+		Actor:     source,
+		Operation: "power",
+		PortID:    powerPortID(location, port),
+		Location:  location,
+		Port:      port,
+		Action:    action,
+		Result:    auditResult(err),
+		Output:    strings.TrimSpace(output),
+		Details:   holder,
+	}
+	if err != nil {
+		entry.Details = err.Error()
+	}
+	recordAudit(entry)
+	return output, err
+}
+
+// switchPortPower is setPortPower on behalf of the holder of a lease, which may
+// switch the leased port
+func switchPortPower(location string, port int, action, source, leaseID string) (string, error) {
+	eventType, ok := powerEventTypes[action]
+	if !ok {
+		return "", fmt.Errorf("invalid action %q", action)
+	}
+
+	portID, err := powerTarget(location, port)
+	if err != nil {
+		return "", err
+	}
+
+	// Leased ports may only be switched by the lease holder
+	if err := checkLease(portID, leaseID); err != nil {
+		return "", err
+	}
+
+	// Ports held off by a rule stay off until the hold is released
+	if action != "off" {
+		if hold, held := powerHolds.get(portID); held {
+			return "", fmt.Errorf("port %s is held off by %s", hold.PortID, hold.Source)
+		}
+	}
+
+	if err := beginPowerAction(); err != nil {
+		return "", err
+	}
+	defer runningPower.wg.Done()
+
+	output, err := runUhubctl("power", "-l", location, "-p", strconv.Itoa(port), "-a", action)
+	observePowerAction(action, err)
+
+	bus, path, _ := splitPortID(portID)
+	event := PortEvent{
+		Type:     eventType,
+		PortID:   portID,
+		Bus:      bus,
+		Location: path,
+		Source:   source,
+		Message:  strings.TrimSpace(string(output)),
+	}
+	if err != nil {
+		event.Type = EventPowerError
+		event.Message = fmt.Sprintf("%s failed: %v: %s", action, err, event.Message)
+	}
+	publishEvent(event)
+
+	return string(output), err
+}
+
+// runningPower tracks running power actions, so that shutdown can let them finish
+var runningPower struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	stopping bool
+}
+
+// beginPowerAction registers a power action, unless the server is shutting down.
+// The caller calls runningPower.wg.Done when finished.
+func beginPowerAction() error {
+	runningPower.mu.Lock()
+	defer runningPower.mu.Unlock()
+	if runningPower.stopping {
+		return fmt.Errorf("server is shutting down")
+	}
+	runningPower.wg.Add(1)
+	return nil
+}
+
+// finishPowerActions refuses new power actions and waits for running ones until
+// the context is done. It reports whether all of them finished.
+func finishPowerActions(ctx context.Context) bool {
+	runningPower.mu.Lock()
+	runningPower.stopping = true
+	runningPower.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		runningPower.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// runUhubctl runs uhubctl through sudo and records how long it took.
+// kind labels the invocation in metrics, e.g. "power" or "status".
+func runUhubctl(kind string, args ...string) ([]byte, error) {
+	start := time.Now()
+	cmd := exec.Command("sudo", append([]string{"uhubctl"}, args...)...)
+	output, err := cmd.CombinedOutput()
+	observeUhubctl(kind, time.Since(start))
+	return output, err
+}
+
+// portPowerTracker remembers the power state ports were last switched to, seeded
+// from uhubctl's status on the first scan
+type portPowerTracker struct {
+	mu     sync.RWMutex
+	states map[string]bool
+	seeded sync.Once
+}
+
+var (
+	// "Current status for hub 1-3.1 [1a40:0101 USB 2.0 Hub, USB 2.00, 4 ports, ppps]"
+	uhubctlHubRe = regexp.MustCompile(`^Current status for hub (\S+)`)
+	// "  Port 2: 0103 power enable connect [0403:6001 FTDI FT232]" or "  Port 3: 0000 off"
+	uhubctlPortRe = regexp.MustCompile(`^\s+Port (\d+): [0-9a-fA-F]{4}\s*(.*)$`)
+)
+
+// parseUhubctlStatus returns the power state of the ports listed in uhubctl's
+// status output, by port ID
+func parseUhubctlStatus(output string) map[string]bool {
+	states := make(map[string]bool)
+	location := ""
+	for _, line := range strings.Split(output, "\n") {
+		if m := uhubctlHubRe.FindStringSubmatch(line); m != nil {
+			location = m[1]
+			continue
+		}
+		m := uhubctlPortRe.FindStringSubmatch(line)
+		if m == nil || location == "" {
+			continue
+		}
+		port, _ := strconv.Atoi(m[1])
+		status := strings.Fields(strings.SplitN(m[2], "[", 2)[0])
+		for _, word := range status {
+			if word == "power" || word == "off" {
+				states[powerPortID(location, port)] = word == "power"
+				break
+			}
+		}
+	}
+	return states
+}
+
+// seed reads the power state of all ports from uhubctl, once, for the ports whose
+// state isn't known from power events yet
+func (t *portPowerTracker) seed() {
+	t.seeded.Do(func() {
+		output, err := runUhubctl("status")
+		if err != nil {
+			log.Printf("Warning: Failed to read port power state from uhubctl: %v", err)
+			return
+		}
+		states := parseUhubctlStatus(string(output))
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		for portID, powered := range states {
+			if _, known := t.states[portID]; !known {
+				t.states[portID] = powered
+			}
+		}
+	})
+}
+
+var portPower = &portPowerTracker{states: make(map[string]bool)}
+
+// handle updates the tracked power state from power events
+func (t *portPowerTracker) handle(event PortEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch event.Type {
+	case EventPowerOn, EventPowerCycle:
+		t.states[event.PortID] = true
+	case EventPowerOff:
+		t.states[event.PortID] = false
+	}
+}
+
+// powered returns whether a port is powered. Ports neither switched through
+// hubcontrol nor listed by uhubctl are assumed to be on; known is false for those.
+func (t *portPowerTracker) powered(portID string) (powered bool, known bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	state, ok := t.states[portID]
+	if !ok {
+		return true, false
+	}
+	return state, true
+}
+
+// annotatePortPower sets the power state of ports whose state is known
+func annotatePortPower(topology *USBTopology) {
+	walkPorts(topology, func(bus int, path string, port *USBPort) {
+		if powered, known := portPower.powered(sysfsName(bus, path)); known {
+			port.Powered = &powered
+		}
+	})
+}
+
+// PowerHold keeps a port powered off until released
+type PowerHold struct {
+	PortID string    `json:"portId"`
+	Source string    `json:"source"` // Who placed the hold, e.g. "rule:overcurrent-off"
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+// HoldConfig configures power holds
+type HoldConfig struct {
+	StateFile string `toml:"state_file"` // Where holds are kept across restarts
+}
+
+const defaultHoldStateFile = "hubcontrol-holds.json"
+
+// powerHoldSet tracks the ports that are held off
+type powerHoldSet struct {
+	mu        sync.Mutex
+	holds     map[string]PowerHold
+	stateFile string
+}
+
+var powerHolds = &powerHoldSet{holds: make(map[string]PowerHold)}
+
+// startHolds restores the holds from the state file
+func startHolds() {
+	h := powerHolds
+	h.stateFile = config.Holds.StateFile
+	if h.stateFile == "" {
+		h.stateFile = defaultHoldStateFile
+	}
+
+	data, err := os.ReadFile(h.stateFile)
+	if err != nil {
+		return
+	}
+	var saved []PowerHold
+	if err := json.Unmarshal(data, &saved); err != nil {
+		log.Printf("Warning: Failed to parse power holds from %s: %v", h.stateFile, err)
+		return
+	}
+	h.mu.Lock()
+	for _, hold := range saved {
+		h.holds[hold.PortID] = hold
+	}
+	h.mu.Unlock()
+	if len(saved) > 0 {
+		log.Printf("Restored %d power hold(s)", len(saved))
+	}
+}
+
+func (h *powerHoldSet) get(portID string) (PowerHold, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hold, ok := h.holds[portID]
+	return hold, ok
+}
+
+func (h *powerHoldSet) set(hold PowerHold) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.holds[hold.PortID] = hold
+	h.save()
+}
+
+// release removes the hold of a port, returning false if it wasn't held
+func (h *powerHoldSet) release(portID string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, ok := h.holds[portID]
+	if ok {
+		delete(h.holds, portID)
+		h.save()
+	}
+	return ok
+}
+
+func (h *powerHoldSet) list() []PowerHold {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	holds := make([]PowerHold, 0, len(h.holds))
+	for _, hold := range h.holds {
+		holds = append(holds, hold)
+	}
+	sort.Slice(holds, func(i, j int) bool { return holds[i].Since.Before(holds[j].Since) })
+	return holds
+}
+
+// save writes the holds to the state file; the caller holds h.mu
+func (h *powerHoldSet) save() {
+	if h.stateFile == "" {
+		return
+	}
+	holds := make([]PowerHold, 0, len(h.holds))
+	for _, hold := range h.holds {
+		holds = append(holds, hold)
+	}
+	data, err := json.MarshalIndent(holds, "", "  ")
+	if err == nil {
+		err = os.WriteFile(h.stateFile, data, 0644)
+	}
+	if err != nil {
+		log.Printf("Warning: Failed to save power holds: %v", err)
+	}
+}
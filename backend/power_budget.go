@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PowerBudget describes the current available on a hub versus what its devices draw
+type PowerBudget struct {
+	SelfPowered bool     `json:"selfPowered"`
+	AvailableMA int      `json:"availableMa"`        // Current the hub can supply downstream
+	UsedMA      int      `json:"usedMa"`             // Sum of configured bMaxPower of attached devices
+	PortLimitMA int      `json:"portLimitMa"`        // Default current limit per downstream port
+	Exceeded    bool     `json:"exceeded"`           // True if UsedMA > AvailableMA or any port is over its limit
+	Warnings    []string `json:"warnings,omitempty"` // Human readable budget violations
+}
+
+// Default currents from the USB 2.0 / 3.x specifications
+const (
+	usb2UnitLoadMA       = 100 // Per port on a bus-powered USB 2.0 hub
+	usb3UnitLoadMA       = 150 // Per port on a bus-powered USB 3.x hub
+	usb2PortCurrentMA    = 500 // Per port on a self-powered USB 2.0 hub, and upstream supply
+	usb3PortCurrentMA    = 900 // Per port on a self-powered USB 3.x hub, and upstream supply
+	superSpeedMinimumMbs = 5000
+)
+
+// speedMbps parses an lsusb speed string like "480M" into megabits per second
+func speedMbps(speed string) float64 {
+	v, _ := strconv.ParseFloat(strings.TrimSuffix(speed, "M"), 64)
+	return v
+}
+
+// deviceLoadMA returns the current a device draws from the port it is plugged into.
+// Bus-powered hubs pass the load of their own downstream devices through.
+func deviceLoadMA(device *USBDevice) int {
+	if device == nil {
+		return 0
+	}
+	if device.PowerBudget != nil && !device.SelfPowered {
+		return device.MaxPowerMA + device.PowerBudget.UsedMA
+	}
+	return device.MaxPowerMA
+}
+
+// applyHubPowerConfig applies the self-powered override from config to a hub
+func applyHubPowerConfig(device *USBDevice, hubConfig *HubConfig) {
+	if hubConfig != nil && hubConfig.SelfPowered != nil {
+		device.SelfPowered = *hubConfig.SelfPowered
+	}
+}
+
+// applyPowerBudgets computes power budgets for every hub in a raw (non-aggregated)
+// topology. Hubs are processed bottom-up so bus-powered child hubs report their load.
+func applyPowerBudgets(device *USBDevice) {
+	applyGroupPowerBudgets(device, device)
+}
+
+// applyGroupPowerBudgets is applyPowerBudgets for a hub within the aggregated group
+// whose top-level hub is top. The top's config describes the aggregated hub as a
+// whole, so internal child hubs only use a config for their own VID:PID.
+func applyGroupPowerBudgets(device, top *USBDevice) {
+	if device == nil || len(device.Ports) == 0 {
+		return
+	}
+	for _, port := range device.Ports {
+		childTop := port.Device
+		if port.Device != nil && isHub(port.Device) && port.Device.VendorID == top.VendorID {
+			// Internal child hub, aggregated into top
+			childTop = top
+		}
+		applyGroupPowerBudgets(port.Device, childTop)
+	}
+	hubConfig := getHubConfig(device.VendorID, device.ProductID)
+	if device != top && device.ProductID == top.ProductID {
+		hubConfig = nil
+	}
+	applyHubPowerConfig(device, hubConfig)
+	device.PowerBudget = hubPowerBudget(device, hubConfig, device.Ports, 0)
+}
+
+// internalHubDrawMA sums the bMaxPower of child hubs that are aggregated into a hub,
+// which aggregateDevice picks by vendor ID
+func internalHubDrawMA(device *USBDevice, vendorID string) int {
+	total := 0
+	for _, port := range device.Ports {
+		if port.Device != nil && isHub(port.Device) && port.Device.VendorID == vendorID {
+			total += port.Device.MaxPowerMA + internalHubDrawMA(port.Device, vendorID)
+		}
+	}
+	return total
+}
+
+// hubPowerBudget computes the budget for a hub given the ports it exposes.
+// internalMA is current consumed by internal child hubs of an aggregated hub.
+func hubPowerBudget(hub *USBDevice, hubConfig *HubConfig, ports []USBPort, internalMA int) *PowerBudget {
+	superSpeed := speedMbps(hub.Speed) >= superSpeedMinimumMbs
+
+	budget := &PowerBudget{SelfPowered: hub.SelfPowered}
+
+	// Per-port limit: config, otherwise the spec default for the hub type
+	switch {
+	case hubConfig != nil && hubConfig.PortLimitMA > 0:
+		budget.PortLimitMA = hubConfig.PortLimitMA
+	case hub.SelfPowered && superSpeed:
+		budget.PortLimitMA = usb3PortCurrentMA
+	case hub.SelfPowered:
+		budget.PortLimitMA = usb2PortCurrentMA
+	case superSpeed:
+		budget.PortLimitMA = usb3UnitLoadMA
+	default:
+		budget.PortLimitMA = usb2UnitLoadMA
+	}
+
+	// Total available: config supply, otherwise what the upstream port or the ports can deliver
+	switch {
+	case hubConfig != nil && hubConfig.SupplyMA > 0:
+		budget.AvailableMA = hubConfig.SupplyMA
+	case hub.SelfPowered:
+		budget.AvailableMA = budget.PortLimitMA * len(ports)
+	case superSpeed:
+		budget.AvailableMA = usb3PortCurrentMA - hub.MaxPowerMA
+	default:
+		budget.AvailableMA = usb2PortCurrentMA - hub.MaxPowerMA
+	}
+
+	budget.UsedMA = internalMA
+	for _, port := range ports {
+		if port.Device == nil {
+			continue
+		}
+		load := deviceLoadMA(port.Device)
+		budget.UsedMA += load
+
+		key := port.PortKey
+		if key == "" {
+			key = fmt.Sprintf("0.%d", port.Port)
+		}
+		limit := budget.PortLimitMA
+		if hubConfig != nil {
+			if l, ok := hubConfig.PortLimitsMA[key]; ok {
+				limit = l
+			}
+		}
+		if load > limit {
+			budget.Warnings = append(budget.Warnings, fmt.Sprintf("%s draws %d mA, port limit is %d mA", portLabel(port), load, limit))
+		}
+	}
+
+	if budget.UsedMA > budget.AvailableMA {
+		budget.Warnings = append(budget.Warnings, fmt.Sprintf("hub draws %d mA, only %d mA available", budget.UsedMA, budget.AvailableMA))
+	}
+	budget.Exceeded = len(budget.Warnings) > 0
+
+	return budget
+}
+
+// portLabel returns a human readable name for a port, preferring the physical port number
+func portLabel(port USBPort) string {
+	switch {
+	case port.MappedPort > 0:
+		return fmt.Sprintf("port %d", port.MappedPort)
+	case port.PortKey != "":
+		return fmt.Sprintf("port %s", port.PortKey)
+	default:
+		return fmt.Sprintf("port %d", port.Port)
+	}
+}
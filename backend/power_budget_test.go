@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestGroupPowerBudgets(t *testing.T) {
+	saved := config.Hubs
+	defer func() { config.Hubs = saved }()
+	config.Hubs = []HubConfig{{VendorID: "1a40", ProductID: "0101", SupplyMA: 2000, PortLimitsMA: map[string]int{"0.2": 50}}}
+
+	// An aggregated hub whose internal child hubs have the same VID:PID as itself
+	hubPorts := func(n int) []USBPort {
+		ports := make([]USBPort, n)
+		for i := range ports {
+			ports[i].Port = i + 1
+		}
+		return ports
+	}
+	childA := &USBDevice{VendorID: "1a40", ProductID: "0101", Class: "Hub", Ports: hubPorts(4)}
+	childA.Ports[1].Device = &USBDevice{VendorID: "0403", ProductID: "6001", MaxPowerMA: 100}
+	childB := &USBDevice{VendorID: "1a40", ProductID: "0101", Class: "Hub", Ports: hubPorts(4)}
+	top := &USBDevice{VendorID: "1a40", ProductID: "0101", Class: "Hub", SelfPowered: true, Ports: hubPorts(4)}
+	top.Ports[0].Device = childA
+	top.Ports[1].Device = childB
+
+	applyPowerBudgets(top)
+
+	if got := top.PowerBudget.AvailableMA; got != 2000 {
+		t.Errorf("top hub: %d mA available, want the configured 2000", got)
+	}
+	if top.PowerBudget.Exceeded {
+		t.Errorf("top hub: unexpected warnings %v", top.PowerBudget.Warnings)
+	}
+	for name, child := range map[string]*USBDevice{"child A": childA, "child B": childB} {
+		if child.PowerBudget.AvailableMA == 2000 {
+			t.Errorf("%s: inherited the aggregated hub's supply", name)
+		}
+	}
+	// The 50 mA limit is for port 2 of the top hub, not of the child hubs
+	if childA.PowerBudget.Exceeded {
+		t.Errorf("child A: unexpected warnings %v", childA.PowerBudget.Warnings)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseUhubctlStatus(t *testing.T) {
+	output := `Current status for hub 2-1 [2109:0817 VIA Labs, Inc. USB3.0 Hub, USB 3.00, 4 ports, ppps]
+  Port 1: 02a0 power 5gbps Rx.Detect
+  Port 2: 0263 power 5gbps U3 enable connect [0781:5581 SanDisk Ultra]
+  Port 3: 0080 off
+Current status for hub 1-3.1 [1a40:0101 Terminus Hub, USB 2.00, 4 ports, ppps]
+  Port 1: 0100 power
+  Port 2: 0103 power enable connect [0403:6001 FTDI FT232]
+  Port 3: 0000 off
+  Port 4: 0503 power highspeed enable connect [1234:5678 Acme off-grid power bank]
+Current status for hub 1 [1d6b:0002 Linux Foundation 2.0 root hub, USB 2.00, 4 ports, ppps]
+  Port 2: 0100 power
+  Port 3: 0000 off
+`
+	want := map[string]bool{
+		"2-1.1":   true,
+		"2-1.2":   true,
+		"2-1.3":   false,
+		"1-3.1.1": true,
+		"1-3.1.2": true,
+		"1-3.1.3": false,
+		"1-3.1.4": true, // "off" in the device name doesn't count
+		"1-2":     true,
+		"1-3":     false,
+	}
+	if got := parseUhubctlStatus(output); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if got := parseUhubctlStatus("No compatible devices detected!\n"); len(got) != 0 {
+		t.Errorf("no hubs: got %v", got)
+	}
+}
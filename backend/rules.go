@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// RuleConfig is a declarative automation rule: when an event matching On and
+// Match happens, run Actions
+type RuleConfig struct {
+	Name    string       `toml:"name" json:"name"`
+	On      []string     `toml:"on" json:"on"`           // Event types, "power" matches all power events
+	Match   RuleMatch    `toml:"match" json:"match"`     // Filters, all set fields must match
+	Actions []RuleAction `toml:"actions" json:"actions"` // Run in order
+	DryRun  bool         `toml:"dry_run" json:"dryRun"`  // Log what would be done without doing it
+	Enabled *bool        `toml:"enabled" json:"enabled,omitempty"`
+}
+
+// RuleMatch filters events by port and device
+type RuleMatch struct {
+	Hub        string `toml:"hub" json:"hub,omitempty"`
+	PortKey    string `toml:"port_key" json:"portKey,omitempty"`
+	MappedPort int    `toml:"mapped_port" json:"mappedPort,omitempty"`
+	PortID     string `toml:"port_id" json:"portId,omitempty"`
+	VendorID   string `toml:"vendor_id" json:"vendorId,omitempty"`
+	ProductID  string `toml:"product_id" json:"productId,omitempty"`
+	Serial     string `toml:"serial" json:"serial,omitempty"`
+	Class      string `toml:"class" json:"class,omitempty"` // Case-insensitive substring of the device class
+}
+
+// RuleAction is something a rule does when it fires
+type RuleAction struct {
+	Type string `toml:"type" json:"type"` // "power", "webhook" or "exec"
+
+	// power: switch the event's port, or the port given by the selector
+	Action string `toml:"action" json:"action,omitempty"` // "on", "off" or "cycle"
+	Hold   bool   `toml:"hold" json:"hold,omitempty"`     // With "off": keep the port off until the hold is released
+	PortSelector
+
+	// webhook: send the event to a [[webhooks]] target, signed and retried as configured there
+	Webhook string `toml:"webhook" json:"webhook,omitempty"` // Name of the target
+
+	// exec: run a command with the event in the environment and as JSON on stdin
+	Command []string `toml:"command" json:"command,omitempty"`
+	Timeout string   `toml:"timeout" json:"timeout,omitempty"` // For exec, default 10s
+}
+
+const (
+	defaultRuleActionTimeout = 10 * time.Second
+	ruleEffectWindow         = 30 * time.Second // How long events on a port a rule switched count as caused by it
+)
+
+// RuleFiring records a rule matching an event
+type RuleFiring struct {
+	Time    time.Time `json:"time"`
+	Rule    string    `json:"rule"`
+	DryRun  bool      `json:"dryRun"`
+	Event   PortEvent `json:"event"`
+	Results []string  `json:"results"` // One line per action
+}
+
+const maxRuleFirings = 100
+
+var (
+	rulesMu     sync.Mutex
+	ruleFirings []RuleFiring
+	ruleEffects = make(map[string]ruleEffect) // Port ID -> last switch by a rule
+)
+
+// ruleEffect remembers a rule switching a port, so that the attach and detach
+// events that follow can be attributed to it
+type ruleEffect struct {
+	source string
+	until  time.Time
+}
+
+// startRules validates the configured rules and subscribes them to port events
+func startRules() {
+	if len(config.Rules) == 0 {
+		return
+	}
+	for i := range config.Rules {
+		rule := &config.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		for _, action := range rule.Actions {
+			if err := validateRuleAction(action); err != nil {
+				log.Printf("Warning: Rule %s: %v", rule.Name, err)
+			}
+		}
+	}
+	log.Printf("Loaded %d automation rule(s)", len(config.Rules))
+
+	subscribeEvents(func(event PortEvent) {
+		event = attributeRuleEffect(event, time.Now())
+		for i := range config.Rules {
+			rule := config.Rules[i]
+			if ruleMatches(rule, event) {
+				go runRule(rule, event)
+			}
+		}
+	})
+}
+
+// validateRuleAction checks an action for missing or invalid settings
+func validateRuleAction(action RuleAction) error {
+	switch action.Type {
+	case "power":
+		if _, ok := powerEventTypes[action.Action]; !ok {
+			return fmt.Errorf("power action needs action = on, off or cycle, got %q", action.Action)
+		}
+	case "webhook":
+		if action.Webhook == "" {
+			return fmt.Errorf("webhook action needs the name of a webhook target")
+		}
+	case "exec":
+		if len(action.Command) == 0 {
+			return fmt.Errorf("exec action needs a command")
+		}
+	default:
+		return fmt.Errorf("unknown action type %q", action.Type)
+	}
+	return nil
+}
+
+// ruleMatches reports whether an event triggers a rule
+func ruleMatches(rule RuleConfig, event PortEvent) bool {
+	if rule.Enabled != nil && !*rule.Enabled {
+		return false
+	}
+	// Don't let a rule trigger itself through the events it causes, directly or
+	// through other rules
+	for _, name := range ruleChain(event) {
+		if name == rule.Name {
+			return false
+		}
+	}
+
+	return eventTypeMatches(rule.On, event.Type) && rule.Match.matches(event)
+}
+
+// ruleChain returns the rules that caused an event, from its source: a rule acting
+// on an event caused by other rules records them all, e.g. "rule:a>b" for rule b
+// acting on an event caused by rule a
+func ruleChain(event PortEvent) []string {
+	if !strings.HasPrefix(event.Source, "rule:") {
+		return nil
+	}
+	return strings.Split(strings.TrimPrefix(event.Source, "rule:"), ">")
+}
+
+// noteRuleEffect records that a rule is switching a port
+func noteRuleEffect(portID, source string) {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	ruleEffects[portID] = ruleEffect{source: source, until: time.Now().Add(ruleEffectWindow)}
+}
+
+// attributeRuleEffect gives an event without a source, such as a detach seen by the
+// monitor, the source of a rule that recently switched its port or a port above it.
+// This keeps a rule like "on detach, cycle" from firing on its own cycles.
+func attributeRuleEffect(event PortEvent, now time.Time) PortEvent {
+	if event.Source != "" || event.PortID == "" {
+		return event
+	}
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	for portID, effect := range ruleEffects {
+		if !now.Before(effect.until) {
+			delete(ruleEffects, portID)
+			continue
+		}
+		if event.PortID == portID || strings.HasPrefix(event.PortID, portID+".") {
+			event.Source = effect.source
+		}
+	}
+	return event
+}
+
+// ruleSource returns the event source for actions of a rule fired by an event
+func ruleSource(rule RuleConfig, event PortEvent) string {
+	return "rule:" + strings.Join(append(ruleChain(event), rule.Name), ">")
+}
+
+// eventTypeMatches reports whether an event type is in a list of types, where
+// "power" stands for all power events
+func eventTypeMatches(types []string, eventType string) bool {
+	for _, t := range types {
+		if t == eventType || (t == "power" && strings.HasPrefix(eventType, "power_")) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether an event passes all set filters
+func (m RuleMatch) matches(event PortEvent) bool {
+	switch {
+	case m.Hub != "" && !strings.EqualFold(m.Hub, event.HubName):
+		return false
+	case m.PortKey != "" && m.PortKey != event.PortKey:
+		return false
+	case m.MappedPort != 0 && m.MappedPort != event.MappedPort:
+		return false
+	case m.PortID != "" && m.PortID != event.PortID:
+		return false
+	case m.VendorID != "" && !strings.EqualFold(m.VendorID, event.VendorID):
+		return false
+	case m.ProductID != "" && !strings.EqualFold(m.ProductID, event.ProductID):
+		return false
+	case m.Serial != "" && m.Serial != event.Serial:
+		return false
+	case m.Class != "" && !strings.Contains(strings.ToLower(event.Class), strings.ToLower(m.Class)):
+		return false
+	}
+	return true
+}
+
+// runRule runs the actions of a rule for an event and records the firing
+func runRule(rule RuleConfig, event PortEvent) {
+	firing := RuleFiring{
+		Time:   time.Now(),
+		Rule:   rule.Name,
+		DryRun: rule.DryRun,
+		Event:  event,
+	}
+
+	for _, action := range rule.Actions {
+		var result string
+		if rule.DryRun {
+			result = "dry run: would " + describeRuleAction(action, event)
+		} else if err := runRuleAction(rule, action, event); err != nil {
+			result = describeRuleAction(action, event) + ": " + err.Error()
+		} else {
+			result = describeRuleAction(action, event) + ": ok"
+		}
+		firing.Results = append(firing.Results, result)
+		log.Printf("Rule %s (%s on %s): %s", rule.Name, event.Type, event.PortID, result)
+	}
+
+	rulesMu.Lock()
+	ruleFirings = append(ruleFirings, firing)
+	if len(ruleFirings) > maxRuleFirings {
+		ruleFirings = ruleFirings[len(ruleFirings)-maxRuleFirings:]
+	}
+	rulesMu.Unlock()
+}
+
+// describeRuleAction returns a short description of what an action does
+func describeRuleAction(action RuleAction, event PortEvent) string {
+	switch action.Type {
+	case "power":
+		target := event.PortID
+		if action.PortSelector != (PortSelector{}) {
+			target = action.PortSelector.String()
+		}
+		if action.Hold {
+			return fmt.Sprintf("power %s %s and hold", action.Action, target)
+		}
+		return fmt.Sprintf("power %s %s", action.Action, target)
+	case "webhook":
+		return "send to webhook " + action.Webhook
+	case "exec":
+		return "run " + strings.Join(action.Command, " ")
+	default:
+		return "unknown action " + action.Type
+	}
+}
+
+// runRuleAction performs a single action
+func runRuleAction(rule RuleConfig, action RuleAction, event PortEvent) error {
+	if err := validateRuleAction(action); err != nil {
+		return err
+	}
+
+	timeout := parseConfigDuration("timeout of rule "+rule.Name, action.Timeout, defaultRuleActionTimeout)
+	source := ruleSource(rule, event)
+
+	switch action.Type {
+	case "power":
+		portID := event.PortID
+		if action.PortSelector != (PortSelector{}) {
+			_, aggregated := monitor.snapshot()
+			if aggregated == nil {
+				return fmt.Errorf("topology not scanned yet")
+			}
+			var err error
+			if portID, err = resolvePort(aggregated, action.PortSelector); err != nil {
+				return err
+			}
+		}
+		location, port, ok := uhubctlTarget(portID)
+		if !ok {
+			return fmt.Errorf("cannot power control port %q", portID)
+		}
+		if action.Action == "off" && action.Hold {
+			hold := PowerHold{
+				PortID: portID,
+				Source: source,
+				Reason: fmt.Sprintf("%s on %s", event.Type, event.PortID),
+				Since:  time.Now(),
+			}
+			powerHolds.set(hold)
+			recordAudit(AuditEntry{Actor: source, Operation: "hold_place", PortID: portID, Result: AuditOK, Details: hold.Reason})
+		}
+		noteRuleEffect(portID, source)
+		output, err := setPortPower(location, port, action.Action, source)
+		if err != nil {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(output))
+		}
+		return nil
+
+	case "webhook":
+		target := findWebhookTarget(action.Webhook)
+		if target == nil {
+			return fmt.Errorf("webhook target %q not found", action.Webhook)
+		}
+		// Delivery is asynchronous; its outcome is listed with the webhook deliveries
+		delivery := target.enqueue(event, rule.Name)
+		webhookDeliveries.Lock()
+		status, errMsg := delivery.Status, delivery.Error
+		webhookDeliveries.Unlock()
+		if status == "failed" || status == "dropped" {
+			return fmt.Errorf("delivery %s %s: %s", delivery.ID, status, errMsg)
+		}
+		return nil
+
+	case "exec":
+		body, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, action.Command[0], action.Command[1:]...)
+		cmd.Stdin = bytes.NewReader(body)
+		cmd.Env = append(os.Environ(),
+			"HUBCONTROL_RULE="+rule.Name,
+			"HUBCONTROL_EVENT="+event.Type,
+			"HUBCONTROL_PORT_ID="+event.PortID,
+			"HUBCONTROL_PORT_KEY="+event.PortKey,
+			"HUBCONTROL_MAPPED_PORT="+strconv.Itoa(event.MappedPort),
+			"HUBCONTROL_HUB="+event.HubName,
+			"HUBCONTROL_VENDOR_ID="+event.VendorID,
+			"HUBCONTROL_PRODUCT_ID="+event.ProductID,
+			"HUBCONTROL_SERIAL="+event.Serial,
+		)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	}
+	return nil
+}
+
+// getRules returns the configured rules and their recent firings
+func getRules(w http.ResponseWriter, r *http.Request) {
+	rulesMu.Lock()
+	firings := append([]RuleFiring(nil), ruleFirings...)
+	rulesMu.Unlock()
+
+	response := map[string]interface{}{
+		"rules":   config.Rules,
+		"firings": firings,
+		"holds":   powerHolds.list(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// releaseHold releases a power hold placed by a rule so the port can be switched on again
+func releaseHold(w http.ResponseWriter, r *http.Request) {
+	portID := mux.Vars(r)["id"]
+	if !checkPortAccess(w, r, portID) {
+		return
+	}
+	if !powerHolds.release(portID) {
+		http.Error(w, "Port is not held", http.StatusNotFound)
+		return
+	}
+	log.Printf("Released power hold on %s", portID)
+	entry := requestAudit(r, "hold_release")
+	entry.PortID = portID
+	recordAudit(entry)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PowerControlResponse{Success: true, Message: "hold released"})
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRuleLoopGuard(t *testing.T) {
+	cycle := RuleConfig{Name: "cycle-on-detach", On: []string{EventDetach}}
+	notify := RuleConfig{Name: "notify", On: []string{EventDetach, "power"}}
+	now := time.Now()
+
+	defer func() { ruleEffects = make(map[string]ruleEffect) }()
+
+	tests := []struct {
+		name  string
+		event PortEvent
+		now   time.Time
+		rule  RuleConfig
+		want  bool
+	}{
+		{"power event of the rule", PortEvent{Type: EventPowerCycle, PortID: "1-3.1", Source: "rule:cycle-on-detach"}, now, cycle, false},
+		{"detach on the switched port", PortEvent{Type: EventDetach, PortID: "1-3.1"}, now, cycle, false},
+		{"detach below the switched port", PortEvent{Type: EventDetach, PortID: "1-3.1.2"}, now, cycle, false},
+		{"detach on another port", PortEvent{Type: EventDetach, PortID: "1-3.2"}, now, cycle, true},
+		{"detach on a sibling with a similar name", PortEvent{Type: EventDetach, PortID: "1-3.10"}, now, cycle, true},
+		{"detach after the window", PortEvent{Type: EventDetach, PortID: "1-3.1"}, now.Add(ruleEffectWindow + time.Second), cycle, true},
+		{"other rules still see the effect", PortEvent{Type: EventDetach, PortID: "1-3.1"}, now, notify, true},
+		{"rule in the chain", PortEvent{Type: EventPowerOn, PortID: "1-3.1", Source: "rule:notify>cycle-on-detach"}, now, notify, false},
+	}
+	for _, tt := range tests {
+		// The cycle rule just switched 1-3.1
+		ruleEffects = make(map[string]ruleEffect)
+		noteRuleEffect("1-3.1", "rule:"+cycle.Name)
+
+		event := attributeRuleEffect(tt.event, tt.now)
+		if got := ruleMatches(tt.rule, event); got != tt.want {
+			t.Errorf("%s: %s matches = %v, want %v (source %q)", tt.name, tt.rule.Name, got, tt.want, event.Source)
+		}
+	}
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// SchedulerConfig configures scheduled power actions
+type SchedulerConfig struct {
+	StateFile string `toml:"state_file"` // Where schedules created through the API are kept
+}
+
+const defaultScheduleStateFile = "hubcontrol-schedules.json"
+
+// ScheduleConfig is a power action run on a cron schedule on a set of ports
+type ScheduleConfig struct {
+	Name   string `toml:"name" json:"name"`
+	Cron   string `toml:"cron" json:"cron"`     // e.g. "0 19 * * mon-fri", "0 */6 * * *" or "@daily"
+	Action string `toml:"action" json:"action"` // "on", "off" or "cycle"
+	PortSet
+	Enabled *bool `toml:"enabled" json:"enabled,omitempty"`
+}
+
+// Schedule is a schedule together with its run state, as returned by the API
+type Schedule struct {
+	ScheduleConfig
+	Source      string     `json:"source"` // "config" or "api"; config schedules are read-only
+	LastRun     *time.Time `json:"lastRun,omitempty"`
+	LastResult  string     `json:"lastResult,omitempty"` // "success", "partial", "error" or "skipped"
+	LastMessage string     `json:"lastMessage,omitempty"`
+	NextRun     *time.Time `json:"nextRun,omitempty"`
+}
+
+// scheduleEntry is a schedule with its parsed cron expression
+type scheduleEntry struct {
+	Schedule
+	cron *cronSchedule
+}
+
+// scheduler runs schedules when they are due
+type scheduler struct {
+	mu        sync.Mutex
+	entries   []*scheduleEntry
+	wake      chan struct{}
+	stateFile string
+}
+
+var schedules = &scheduler{wake: make(chan struct{}, 1)}
+
+// validateSchedule checks a schedule and parses its cron expression
+func validateSchedule(cfg ScheduleConfig) (*cronSchedule, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("schedule needs a name")
+	}
+	if _, ok := powerEventTypes[cfg.Action]; !ok {
+		return nil, fmt.Errorf("schedule %s: action must be on, off or cycle", cfg.Name)
+	}
+	if cfg.Hub == "" && len(cfg.PortIDs) == 0 {
+		return nil, fmt.Errorf("schedule %s: needs a hub or port IDs", cfg.Name)
+	}
+	cron, err := parseCron(cfg.Cron)
+	if err != nil {
+		return nil, fmt.Errorf("schedule %s: %v", cfg.Name, err)
+	}
+	return cron, nil
+}
+
+// startScheduler loads schedules from config and the state file and starts running them
+func startScheduler() {
+	schedules.stateFile = config.Scheduler.StateFile
+	if schedules.stateFile == "" {
+		schedules.stateFile = defaultScheduleStateFile
+	}
+
+	for _, cfg := range config.Schedules {
+		if _, err := schedules.add(cfg, "config"); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+
+	if data, err := os.ReadFile(schedules.stateFile); err == nil {
+		var saved []ScheduleConfig
+		if err := json.Unmarshal(data, &saved); err != nil {
+			log.Printf("Warning: Failed to parse schedules from %s: %v", schedules.stateFile, err)
+		}
+		for _, cfg := range saved {
+			if _, err := schedules.add(cfg, "api"); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+		}
+	}
+
+	if n := len(schedules.entries); n > 0 {
+		log.Printf("Loaded %d power schedule(s)", n)
+	}
+	go schedules.loop()
+}
+
+// add registers a schedule and returns it as added, failing if the name is taken
+// or the schedule is invalid
+func (s *scheduler) add(cfg ScheduleConfig, source string) (Schedule, error) {
+	cron, err := validateSchedule(cfg)
+	if err != nil {
+		return Schedule{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.find(cfg.Name) != nil {
+		return Schedule{}, fmt.Errorf("schedule %s already exists", cfg.Name)
+	}
+	entry := &scheduleEntry{Schedule: Schedule{ScheduleConfig: cfg, Source: source}, cron: cron}
+	entry.planNext(time.Now())
+	s.entries = append(s.entries, entry)
+	s.notify()
+	return entry.Schedule, nil
+}
+
+// find returns the entry with the given name; the caller holds s.mu
+func (s *scheduler) find(name string) *scheduleEntry {
+	for _, e := range s.entries {
+		if e.Name == name {
+			return e
+		}
+	}
+	return nil
+}
+
+// notify wakes the scheduler loop to recompute the next due time
+func (s *scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// enabled reports whether the schedule should run
+func (e *scheduleEntry) enabled() bool {
+	return e.Enabled == nil || *e.Enabled
+}
+
+// planNext computes the next run after t
+func (e *scheduleEntry) planNext(t time.Time) {
+	e.NextRun = nil
+	if !e.enabled() {
+		return
+	}
+	if next := e.cron.next(t); !next.IsZero() {
+		e.NextRun = &next
+	}
+}
+
+// loop runs due schedules and sleeps until the next one, waking up on changes
+func (s *scheduler) loop() {
+	for {
+		now := time.Now()
+		wait := time.Minute
+
+		var due []*scheduleEntry
+		s.mu.Lock()
+		for _, e := range s.entries {
+			if e.NextRun == nil {
+				continue
+			}
+			if !e.NextRun.After(now) {
+				due = append(due, e)
+				e.planNext(now)
+			}
+			if e.NextRun != nil && e.NextRun.Sub(now) < wait {
+				wait = e.NextRun.Sub(now)
+			}
+		}
+		s.mu.Unlock()
+
+		for _, e := range due {
+			go s.run(e)
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-s.wake:
+		}
+	}
+}
+
+// run performs a schedule's power action on all its ports, skipping protected
+// ports for anything but switching them on
+func (s *scheduler) run(e *scheduleEntry) {
+	s.mu.Lock()
+	cfg := e.ScheduleConfig
+	s.mu.Unlock()
+
+	result, message := runSchedule(cfg)
+	log.Printf("Schedule %s (%s): %s: %s", cfg.Name, cfg.Action, result, message)
+
+	now := time.Now()
+	s.mu.Lock()
+	e.LastRun = &now
+	e.LastResult = result
+	e.LastMessage = message
+	s.mu.Unlock()
+}
+
+// runSchedule executes a schedule once and summarizes the outcome
+func runSchedule(cfg ScheduleConfig) (result, message string) {
+	_, aggregated := monitor.snapshot()
+	if aggregated == nil {
+		return "error", "topology not scanned yet"
+	}
+	targets, err := resolvePortSet(aggregated, cfg.PortSet)
+	if err != nil {
+		return "error", err.Error()
+	}
+	protected := protectedPortIDs(aggregated)
+
+	var done, skipped int
+	var failures []string
+	for _, portID := range targets {
+		if cfg.Action != "on" && protected[portID] {
+			skipped++
+			continue
+		}
+		location, port, ok := uhubctlTarget(portID)
+		if !ok {
+			failures = append(failures, fmt.Sprintf("%s: invalid port", portID))
+			continue
+		}
+		if output, err := setPortPower(location, port, cfg.Action, "schedule:"+cfg.Name); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v %s", portID, err, strings.TrimSpace(output)))
+			continue
+		}
+		done++
+	}
+
+	message = fmt.Sprintf("%d port(s) switched %s", done, cfg.Action)
+	if skipped > 0 {
+		message += fmt.Sprintf(", %d protected port(s) skipped", skipped)
+	}
+	if len(failures) > 0 {
+		message += "; failed: " + strings.Join(failures, "; ")
+	}
+
+	switch {
+	case len(failures) > 0 && done == 0:
+		result = "error"
+	case len(failures) > 0:
+		result = "partial"
+	case done == 0:
+		result = "skipped"
+	default:
+		result = "success"
+	}
+	return result, message
+}
+
+// save writes the schedules created through the API to the state file; the caller holds s.mu
+func (s *scheduler) save() error {
+	saved := make([]ScheduleConfig, 0)
+	for _, e := range s.entries {
+		if e.Source == "api" {
+			saved = append(saved, e.ScheduleConfig)
+		}
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.stateFile, data, 0644)
+}
+
+// list returns a copy of all schedules
+func (s *scheduler) list() []Schedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]Schedule, 0, len(s.entries))
+	for _, e := range s.entries {
+		result = append(result, e.Schedule)
+	}
+	return result
+}
+
+// checkScheduleAccess responds with 403 and returns false if the request may not
+// switch all ports of a schedule. Schedules run without the caller, so their ports
+// are checked when they are created, changed or run through the API.
+func checkScheduleAccess(w http.ResponseWriter, r *http.Request, cfg ScheduleConfig) bool {
+	var targets []string
+	err := fmt.Errorf("topology not scanned yet")
+	if _, aggregated := monitor.snapshot(); aggregated != nil {
+		targets, err = resolvePortSet(aggregated, cfg.PortSet)
+	}
+	if err != nil {
+		// Ports that can't be resolved can't be checked, only allow those who may control all ports
+		if !requestAccess(r).controlsAll() {
+			http.Error(w, fmt.Sprintf("Cannot check access to the schedule's ports: %v", err), http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+	return checkPortAccess(w, r, targets...)
+}
+
+func writeScheduleJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// listSchedules returns all schedules with their last and next run
+func listSchedules(w http.ResponseWriter, r *http.Request) {
+	writeScheduleJSON(w, http.StatusOK, schedules.list())
+}
+
+// getSchedule returns a single schedule
+func getSchedule(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	for _, s := range schedules.list() {
+		if s.Name == name {
+			writeScheduleJSON(w, http.StatusOK, s)
+			return
+		}
+	}
+	http.Error(w, "Schedule not found", http.StatusNotFound)
+}
+
+// createSchedule adds a schedule and persists it
+func createSchedule(w http.ResponseWriter, r *http.Request) {
+	var cfg ScheduleConfig
+	if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !checkScheduleAccess(w, r, cfg) {
+		return
+	}
+	entry, err := schedules.add(cfg, "api")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	schedules.mu.Lock()
+	err = schedules.save()
+	schedules.mu.Unlock()
+	if err != nil {
+		log.Printf("Warning: Failed to save schedules: %v", err)
+	}
+	auditSchedule(r, "schedule_create", cfg, "")
+
+	writeScheduleJSON(w, http.StatusCreated, entry)
+}
+
+// updateSchedule replaces a schedule created through the API
+func updateSchedule(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	var cfg ScheduleConfig
+	if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cfg.Name = name
+	cron, err := validateSchedule(cfg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	existing, ok := findAPISchedule(w, name)
+	if !ok {
+		return
+	}
+	// The caller must control the ports the schedule switches now and those it will switch
+	if !checkScheduleAccess(w, r, existing) || !checkScheduleAccess(w, r, cfg) {
+		return
+	}
+
+	schedules.mu.Lock()
+	defer schedules.mu.Unlock()
+	entry := schedules.find(name)
+	if entry == nil {
+		http.Error(w, "Schedule not found", http.StatusNotFound)
+		return
+	}
+	entry.ScheduleConfig = cfg
+	entry.cron = cron
+	entry.planNext(time.Now())
+	schedules.notify()
+	if err := schedules.save(); err != nil {
+		log.Printf("Warning: Failed to save schedules: %v", err)
+	}
+	auditSchedule(r, "schedule_update", cfg, "")
+
+	writeScheduleJSON(w, http.StatusOK, entry.Schedule)
+}
+
+// deleteSchedule removes a schedule created through the API
+func deleteSchedule(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	existing, ok := findAPISchedule(w, name)
+	if !ok {
+		return
+	}
+	if !checkScheduleAccess(w, r, existing) {
+		return
+	}
+
+	schedules.mu.Lock()
+	defer schedules.mu.Unlock()
+	for i, e := range schedules.entries {
+		if e.Name != name {
+			continue
+		}
+		schedules.entries = append(schedules.entries[:i], schedules.entries[i+1:]...)
+		schedules.notify()
+		if err := schedules.save(); err != nil {
+			log.Printf("Warning: Failed to save schedules: %v", err)
+		}
+		auditSchedule(r, "schedule_delete", e.ScheduleConfig, "")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Error(w, "Schedule not found", http.StatusNotFound)
+}
+
+// findAPISchedule returns the config of a schedule created through the API,
+// responding with an error if there is none
+func findAPISchedule(w http.ResponseWriter, name string) (ScheduleConfig, bool) {
+	schedules.mu.Lock()
+	defer schedules.mu.Unlock()
+	entry := schedules.find(name)
+	if entry == nil {
+		http.Error(w, "Schedule not found", http.StatusNotFound)
+		return ScheduleConfig{}, false
+	}
+	if entry.Source != "api" {
+		http.Error(w, "Schedules from the config file are read-only", http.StatusConflict)
+		return ScheduleConfig{}, false
+	}
+	return entry.ScheduleConfig, true
+}
+
+// runScheduleNow runs a schedule immediately, regardless of its cron expression
+func runScheduleNow(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	schedules.mu.Lock()
+	entry := schedules.find(name)
+	var cfg ScheduleConfig
+	if entry != nil {
+		cfg = entry.ScheduleConfig
+	}
+	schedules.mu.Unlock()
+	if entry == nil {
+		http.Error(w, "Schedule not found", http.StatusNotFound)
+		return
+	}
+	if !checkScheduleAccess(w, r, cfg) {
+		return
+	}
+
+	schedules.run(entry)
+
+	schedules.mu.Lock()
+	result := entry.Schedule
+	schedules.mu.Unlock()
+	auditSchedule(r, "schedule_run", cfg, result.LastResult+": "+result.LastMessage)
+	writeScheduleJSON(w, http.StatusOK, result)
+}
+
+// auditSchedule records a change to or run of a schedule in the audit log
+func auditSchedule(r *http.Request, operation string, cfg ScheduleConfig, outcome string) {
+	entry := requestAudit(r, operation)
+	entry.Action = cfg.Action
+	entry.Details = fmt.Sprintf("schedule %q (%s)", cfg.Name, cfg.Cron)
+	if outcome != "" {
+		entry.Details += ": " + outcome
+	}
+	recordAudit(entry)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ServerConfig configures where the server listens and how it shuts down
+type ServerConfig struct {
+	Listen          []string `toml:"listen"`           // TCP addresses, default [":8080"]
+	Socket          string   `toml:"socket"`           // Unix domain socket path, e.g. "/run/hubcontrol/api.sock"
+	SocketMode      string   `toml:"socket_mode"`      // Octal permissions of the socket, default "0660"
+	SocketGroup     string   `toml:"socket_group"`     // Group owning the socket, e.g. "plugdev"
+	SocketTrusted   bool     `toml:"socket_trusted"`   // Treat socket clients as admin "local" without a token
+	StaticPath      string   `toml:"static_path"`      // Serve the frontend from this directory instead of the embedded build
+	ShutdownTimeout string   `toml:"shutdown_timeout"` // How long to wait for requests and power actions, default "30s"
+}
+
+const (
+	defaultListenAddress   = ":8080"
+	defaultSocketMode      = 0660
+	defaultShutdownTimeout = 30 * time.Second
+)
+
+// listFlag collects a repeatable command-line flag; values may also be comma separated
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// flags holds the command-line flags, which override the config file
+var flags struct {
+	config string
+	listen listFlag
+	socket string
+	static string
+}
+
+// parseFlags parses the command line
+func parseFlags() {
+	flag.StringVar(&flags.config, "config", "", "config file (default: search config.toml, ../config.toml, /etc/hubcontrol/config.toml)")
+	flag.Var(&flags.listen, "listen", "TCP address to listen on, may be repeated (default \":8080\")")
+	flag.StringVar(&flags.socket, "socket", "", "Unix domain socket to listen on")
+	flag.StringVar(&flags.static, "static", "", "serve the frontend from this directory instead of the embedded build, e.g. during development")
+	flag.Parse()
+}
+
+// applyFlags overrides the server config with command-line flags
+func applyFlags() {
+	if len(flags.listen) > 0 {
+		config.Server.Listen = flags.listen
+	}
+	if flags.socket != "" {
+		config.Server.Socket = flags.socket
+	}
+	if flags.static != "" {
+		config.Server.StaticPath = flags.static
+	}
+}
+
+type localConnKey struct{}
+
+// serverStopping is closed when shutdown begins, to end long-lived requests such as event streams
+var serverStopping = make(chan struct{})
+
+// isLocalRequest reports whether a request came in on a Unix domain socket
+func isLocalRequest(r *http.Request) bool {
+	local, _ := r.Context().Value(localConnKey{}).(bool)
+	return local
+}
+
+// runServer serves the handler on all listeners until SIGTERM or SIGINT, then
+// shuts down gracefully: open requests and running power actions may finish
+// within the shutdown timeout.
+func runServer(handler http.Handler) {
+	tlsConfig, err := serverTLSConfig()
+	if err != nil {
+		log.Fatalf("TLS: %v", err)
+	}
+
+	listeners, err := systemdListeners()
+	if err != nil {
+		log.Fatalf("Socket activation: %v", err)
+	}
+	if len(listeners) > 0 {
+		log.Printf("Using %d socket(s) passed by systemd", len(listeners))
+	} else if listeners, err = serverListeners(); err != nil {
+		log.Fatal(err)
+	}
+
+	server := &http.Server{
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, localConnKey{}, c.LocalAddr().Network() == "unix")
+		},
+	}
+	server.RegisterOnShutdown(func() { close(serverStopping) })
+
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			var err error
+			// Local tools on the Unix socket speak plain HTTP
+			if tlsConfig != nil && l.Addr().Network() != "unix" {
+				log.Printf("Server listening on %s (HTTPS)", l.Addr())
+				err = server.ServeTLS(l, "", "")
+			} else {
+				log.Printf("Server listening on %s", l.Addr())
+				err = server.Serve(l)
+			}
+			if !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("Server on %s failed: %v", l.Addr(), err)
+			}
+		}(l)
+	}
+	sdNotify("READY=1")
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	log.Printf("Received %s, shutting down", sig)
+	sdNotify("STOPPING=1")
+
+	timeout := parseConfigDuration("shutdown_timeout", config.Server.ShutdownTimeout, defaultShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Warning: Open requests did not finish: %v", err)
+	}
+	if !finishPowerActions(ctx) {
+		log.Println("Warning: Power actions still running at shutdown")
+	}
+	log.Println("Server stopped")
+}
+
+// serverListeners opens the configured TCP addresses and Unix socket
+func serverListeners() ([]net.Listener, error) {
+	addresses := config.Server.Listen
+	if len(addresses) == 0 && config.Server.Socket == "" {
+		addresses = []string{defaultListenAddress}
+	}
+
+	var listeners []net.Listener
+	for _, address := range addresses {
+		l, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+
+	if path := config.Server.Socket; path != "" {
+		l, err := listenUnix(path)
+		if err != nil {
+			return nil, fmt.Errorf("socket %s: %w", path, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// listenUnix listens on a Unix domain socket with the configured permissions,
+// replacing a socket left behind by a previous run
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	mode := os.FileMode(defaultSocketMode)
+	if m := config.Server.SocketMode; m != "" {
+		parsed, err := strconv.ParseUint(m, 8, 32)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("invalid socket_mode %q", m)
+		}
+		mode = os.FileMode(parsed)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	if name := config.Server.SocketGroup; name != "" {
+		group, err := user.LookupGroup(name)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		gid, _ := strconv.Atoi(group.Gid)
+		if err := os.Chown(path, -1, gid); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// systemdListeners returns the sockets passed by systemd socket activation
+// (LISTEN_PID/LISTEN_FDS), starting at file descriptor 3
+func systemdListeners() ([]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	// Don't pass the sockets on to commands run by rules
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	const firstFD = 3
+	var listeners []net.Listener
+	for fd := firstFD; fd < firstFD+count; fd++ {
+		syscall.CloseOnExec(fd)
+		file := os.NewFile(uintptr(fd), fmt.Sprintf("systemd-socket-%d", fd))
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("file descriptor %d: %w", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// sdNotify sends a state change to systemd when running as a Type=notify service
+func sdNotify(state string) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return
+	}
+	if strings.HasPrefix(path, "@") {
+		// Abstract socket namespace
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		log.Printf("Warning: Failed to notify systemd: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("Warning: Failed to notify systemd: %v", err)
+	}
+}
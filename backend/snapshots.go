@@ -0,0 +1,543 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+// SnapshotConfig configures topology snapshots, which are kept in the history database
+type SnapshotConfig struct {
+	Disabled  bool   `toml:"disabled"`
+	Interval  string `toml:"interval"`  // Periodic snapshots, default "1h", taken only if the topology changed
+	Retention string `toml:"retention"` // Maximum age of snapshots, default "720h"
+}
+
+const (
+	defaultSnapshotInterval  = time.Hour
+	defaultSnapshotRetention = 30 * 24 * time.Hour
+)
+
+// Snapshot triggers
+const (
+	SnapshotPeriodic = "periodic"
+	SnapshotManual   = "manual"
+	SnapshotCurrent  = "current" // The live topology in a diff, not stored
+)
+
+// TopologySnapshot is the raw topology at one point in time, with the power state
+// of the ports switched since the server started
+type TopologySnapshot struct {
+	SnapshotInfo
+	Topology *USBTopology `json:"topology"`
+}
+
+// SnapshotInfo describes a snapshot without its topology
+type SnapshotInfo struct {
+	ID      uint64    `json:"id"` // 0 for the current topology
+	Time    time.Time `json:"time"`
+	Trigger string    `json:"trigger"`
+	Note    string    `json:"note,omitempty"`
+	Devices int       `json:"devices"`
+}
+
+// SnapshotDevice is a device and the port it is plugged into
+type SnapshotDevice struct {
+	PortID     string `json:"portId"`
+	HubName    string `json:"hubName,omitempty"`
+	MappedPort int    `json:"mappedPort,omitempty"`
+	VendorID   string `json:"vendorId"`
+	ProductID  string `json:"productId"`
+	Name       string `json:"name"`
+	Serial     string `json:"serial,omitempty"`
+	Speed      string `json:"speed"`
+}
+
+// DeviceMove is a device found on another port. The embedded device is at its new port.
+type DeviceMove struct {
+	SnapshotDevice
+	FromPortID     string `json:"fromPortId"`
+	FromHubName    string `json:"fromHubName,omitempty"`
+	FromMappedPort int    `json:"fromMappedPort,omitempty"`
+	FromSpeed      string `json:"fromSpeed,omitempty"` // If it also connected at another speed
+}
+
+// SpeedChange is a device that connected at another speed. Speed is the new one.
+type SpeedChange struct {
+	SnapshotDevice
+	FromSpeed string `json:"fromSpeed"`
+}
+
+// PowerChange is a port that was switched
+type PowerChange struct {
+	PortID     string `json:"portId"`
+	HubName    string `json:"hubName,omitempty"`
+	MappedPort int    `json:"mappedPort,omitempty"`
+	From       bool   `json:"from"` // Powered
+	To         bool   `json:"to"`
+}
+
+// TopologyDiff is what changed between two snapshots
+type TopologyDiff struct {
+	From         SnapshotInfo     `json:"from"`
+	To           SnapshotInfo     `json:"to"`
+	Added        []SnapshotDevice `json:"added"`
+	Removed      []SnapshotDevice `json:"removed"`
+	Moved        []DeviceMove     `json:"moved"`
+	SpeedChanged []SpeedChange    `json:"speedChanged"`
+	PowerChanged []PowerChange    `json:"powerChanged"`
+}
+
+// snapshotStore keeps snapshots in a bucket of the history database, keyed by ID
+type snapshotStore struct {
+	db        *bolt.DB
+	retention time.Duration
+}
+
+var snapshots *snapshotStore
+
+var snapshotsBucket = []byte("snapshots")
+
+// startSnapshots takes periodic snapshots into the history database
+func startSnapshots() {
+	cfg := config.Snapshots
+	if cfg.Disabled {
+		return
+	}
+	if history == nil {
+		log.Printf("Warning: Topology snapshots need the history database, which is disabled")
+		return
+	}
+
+	interval := parseConfigDuration("snapshot interval", cfg.Interval, defaultSnapshotInterval)
+
+	store, err := newSnapshotStore(history.db)
+	if err != nil {
+		log.Printf("Warning: Failed to initialize topology snapshots: %v", err)
+		return
+	}
+	snapshots = store
+	log.Printf("Taking topology snapshots every %s", interval)
+
+	go func() {
+		for {
+			if _, err := snapshots.take(SnapshotPeriodic, ""); err != nil {
+				log.Printf("Warning: Failed to take topology snapshot: %v", err)
+			}
+			snapshots.prune()
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// newSnapshotStore prepares the snapshot bucket of a database
+func newSnapshotStore(db *bolt.DB) (*snapshotStore, error) {
+	retention := parseConfigDuration("snapshot retention", config.Snapshots.Retention, defaultSnapshotRetention)
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(snapshotsBucket)
+		return err
+	})
+	return &snapshotStore{db: db, retention: retention}, err
+}
+
+// currentSnapshot scans the topology into an unsaved snapshot
+func currentSnapshot(trigger, note string) (*TopologySnapshot, error) {
+	topology, err := parseUSBTopology()
+	if err != nil {
+		return nil, err
+	}
+	annotatePortPower(topology)
+	snapshot := &TopologySnapshot{
+		SnapshotInfo: SnapshotInfo{Time: time.Now(), Trigger: trigger, Note: note},
+		Topology:     topology,
+	}
+	snapshot.Devices = len(snapshotDevices(topology))
+	return snapshot, nil
+}
+
+// take scans and stores a snapshot. Periodic snapshots are skipped if nothing
+// changed since the last one, and nil is returned.
+func (s *snapshotStore) take(trigger, note string) (*SnapshotInfo, error) {
+	snapshot, err := currentSnapshot(trigger, note)
+	if err != nil {
+		return nil, err
+	}
+	if trigger == SnapshotPeriodic {
+		if last, err := s.latest(); err == nil && last != nil && !topologyDiff(last, snapshot).changed() {
+			return nil, nil
+		}
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(snapshotsBucket)
+		snapshot.ID, _ = bucket.NextSequence()
+		data, err := json.Marshal(snapshot)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(snapshotKey(snapshot.ID), data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Topology snapshot %d (%s): %d devices", snapshot.ID, trigger, snapshot.Devices)
+	return &snapshot.SnapshotInfo, nil
+}
+
+func snapshotKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+// get returns a snapshot by ID, or nil if there is none
+func (s *snapshotStore) get(id uint64) (*TopologySnapshot, error) {
+	var snapshot *TopologySnapshot
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(snapshotsBucket).Get(snapshotKey(id))
+		if data == nil {
+			return nil
+		}
+		snapshot = &TopologySnapshot{}
+		return json.Unmarshal(data, snapshot)
+	})
+	return snapshot, err
+}
+
+// latest returns the newest snapshot, or nil if there is none
+func (s *snapshotStore) latest() (*TopologySnapshot, error) {
+	return s.before(time.Now())
+}
+
+// before returns the newest snapshot taken at or before t, or nil
+func (s *snapshotStore) before(t time.Time) (*TopologySnapshot, error) {
+	var snapshot *TopologySnapshot
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(snapshotsBucket).Cursor()
+		for k, data := c.Last(); k != nil; k, data = c.Prev() {
+			var candidate TopologySnapshot
+			if err := json.Unmarshal(data, &candidate); err != nil {
+				return err
+			}
+			if !candidate.Time.After(t) {
+				snapshot = &candidate
+				return nil
+			}
+		}
+		return nil
+	})
+	return snapshot, err
+}
+
+// list returns all snapshots without their topology, oldest first
+func (s *snapshotStore) list() ([]SnapshotInfo, error) {
+	infos := make([]SnapshotInfo, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(snapshotsBucket).ForEach(func(k, data []byte) error {
+			var info SnapshotInfo
+			if err := json.Unmarshal(data, &info); err != nil {
+				return err
+			}
+			infos = append(infos, info)
+			return nil
+		})
+	})
+	return infos, err
+}
+
+// prune deletes snapshots older than the retention
+func (s *snapshotStore) prune() {
+	cutoff := time.Now().Add(-s.retention)
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(snapshotsBucket)
+		var stale [][]byte
+		c := bucket.Cursor()
+		for k, data := c.First(); k != nil; k, data = c.Next() {
+			var info SnapshotInfo
+			if err := json.Unmarshal(data, &info); err != nil || info.Time.After(cutoff) {
+				break
+			}
+			stale = append(stale, append([]byte(nil), k...))
+		}
+		for _, k := range stale {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Warning: Failed to prune topology snapshots: %v", err)
+	}
+}
+
+// resolve finds the snapshot a diff parameter refers to: a snapshot ID, "now"
+// for the current topology, or a time (RFC 3339 or a duration ago) for the
+// newest snapshot taken by then
+func (s *snapshotStore) resolve(value string) (*TopologySnapshot, error) {
+	if value == "now" {
+		return currentSnapshot(SnapshotCurrent, "")
+	}
+	if id, err := strconv.ParseUint(value, 10, 64); err == nil {
+		snapshot, err := s.get(id)
+		if err == nil && snapshot == nil {
+			err = fmt.Errorf("no snapshot %d", id)
+		}
+		return snapshot, err
+	}
+	t, err := parseHistoryTime(value, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("%q is neither a snapshot ID, \"now\" nor a time", value)
+	}
+	snapshot, err := s.before(t)
+	if err == nil && snapshot == nil {
+		err = fmt.Errorf("no snapshot taken by %s", t.Format(time.RFC3339))
+	}
+	return snapshot, err
+}
+
+// snapshotDevices lists the devices of a raw topology below the root hubs, with
+// their place on the aggregated hubs
+func snapshotDevices(raw *USBTopology) []SnapshotDevice {
+	refs := buildPortRefs(aggregateTopology(raw))
+	var devices []SnapshotDevice
+	walkDevices(raw, func(bus int, path string, depth int, device *USBDevice) {
+		if path == "" {
+			return
+		}
+		portID := sysfsName(bus, path)
+		devices = append(devices, SnapshotDevice{
+			PortID:     portID,
+			HubName:    refs[portID].HubName,
+			MappedPort: refs[portID].MappedPort,
+			VendorID:   device.VendorID,
+			ProductID:  device.ProductID,
+			Name:       device.Name,
+			Serial:     device.Serial,
+			Speed:      device.Speed,
+		})
+	})
+	return devices
+}
+
+// identity is what makes a device the same device on another port
+func (d SnapshotDevice) identity() string {
+	if d.Serial != "" {
+		return d.VendorID + ":" + d.ProductID + "/" + d.Serial
+	}
+	return d.VendorID + ":" + d.ProductID + " " + d.Name
+}
+
+// changed reports whether the diff found any difference
+func (d *TopologyDiff) changed() bool {
+	return len(d.Added) > 0 || len(d.Removed) > 0 || len(d.Moved) > 0 ||
+		len(d.SpeedChanged) > 0 || len(d.PowerChanged) > 0
+}
+
+// topologyDiff compares two snapshots. A device gone from one port and found on
+// another is moved; devices without a serial number are told apart by vendor,
+// product and name only.
+func topologyDiff(from, to *TopologySnapshot) *TopologyDiff {
+	diff := &TopologyDiff{
+		From:         from.SnapshotInfo,
+		To:           to.SnapshotInfo,
+		Added:        make([]SnapshotDevice, 0),
+		Removed:      make([]SnapshotDevice, 0),
+		Moved:        make([]DeviceMove, 0),
+		SpeedChanged: make([]SpeedChange, 0),
+		PowerChanged: make([]PowerChange, 0),
+	}
+
+	before := make(map[string]SnapshotDevice)
+	for _, d := range snapshotDevices(from.Topology) {
+		before[d.PortID] = d
+	}
+	after := snapshotDevices(to.Topology)
+
+	var added []SnapshotDevice
+	for _, d := range after {
+		old, ok := before[d.PortID]
+		if ok && old.identity() == d.identity() {
+			if old.Speed != d.Speed {
+				diff.SpeedChanged = append(diff.SpeedChanged, SpeedChange{SnapshotDevice: d, FromSpeed: old.Speed})
+			}
+			delete(before, d.PortID)
+			continue
+		}
+		added = append(added, d)
+	}
+
+	// What's left of before is gone from its port, unless it turns up on another
+	var removed []SnapshotDevice
+	for _, d := range before {
+		removed = append(removed, d)
+	}
+	sort.Slice(removed, func(i, j int) bool { return removed[i].PortID < removed[j].PortID })
+	for _, d := range added {
+		moved := false
+		for i, old := range removed {
+			if old.identity() == d.identity() {
+				move := DeviceMove{
+					SnapshotDevice: d,
+					FromPortID:     old.PortID,
+					FromHubName:    old.HubName,
+					FromMappedPort: old.MappedPort,
+				}
+				if old.Speed != d.Speed {
+					move.FromSpeed = old.Speed
+				}
+				diff.Moved = append(diff.Moved, move)
+				removed = append(removed[:i], removed[i+1:]...)
+				moved = true
+				break
+			}
+		}
+		if !moved {
+			diff.Added = append(diff.Added, d)
+		}
+	}
+	diff.Removed = append(diff.Removed, removed...)
+
+	// Power changes of ports whose state is known in both
+	refs := buildPortRefs(aggregateTopology(to.Topology))
+	powered := portPowerStates(from.Topology)
+	for portID, now := range portPowerStates(to.Topology) {
+		if was, ok := powered[portID]; ok && was != now {
+			diff.PowerChanged = append(diff.PowerChanged, PowerChange{
+				PortID:     portID,
+				HubName:    refs[portID].HubName,
+				MappedPort: refs[portID].MappedPort,
+				From:       was,
+				To:         now,
+			})
+		}
+	}
+	sort.Slice(diff.PowerChanged, func(i, j int) bool { return diff.PowerChanged[i].PortID < diff.PowerChanged[j].PortID })
+	return diff
+}
+
+// portPowerStates returns the known power state of the ports of a topology
+func portPowerStates(topology *USBTopology) map[string]bool {
+	states := make(map[string]bool)
+	walkPorts(topology, func(bus int, path string, port *USBPort) {
+		if port.Powered != nil {
+			states[sysfsName(bus, path)] = *port.Powered
+		}
+	})
+	return states
+}
+
+// listSnapshots returns the stored snapshots without their topology
+func listSnapshots(w http.ResponseWriter, r *http.Request) {
+	if snapshots == nil {
+		http.Error(w, "Topology snapshots are disabled", http.StatusServiceUnavailable)
+		return
+	}
+	infos, err := snapshots.list()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
+
+// SnapshotRequest is the optional body of POST /api/topology/snapshots
+type SnapshotRequest struct {
+	Note string `json:"note"`
+}
+
+// createSnapshot takes a snapshot on demand
+func createSnapshot(w http.ResponseWriter, r *http.Request) {
+	if snapshots == nil {
+		http.Error(w, "Topology snapshots are disabled", http.StatusServiceUnavailable)
+		return
+	}
+	var req SnapshotRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	info, err := snapshots.take(SnapshotManual, req.Note)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(info)
+}
+
+// getSnapshot returns a snapshot with its topology
+func getSnapshot(w http.ResponseWriter, r *http.Request) {
+	if snapshots == nil {
+		http.Error(w, "Topology snapshots are disabled", http.StatusServiceUnavailable)
+		return
+	}
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid snapshot ID", http.StatusBadRequest)
+		return
+	}
+	snapshot, err := snapshots.get(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if snapshot == nil {
+		http.Error(w, "Snapshot not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// getTopologyDiff compares two snapshots. from defaults to the newest snapshot,
+// to to the current topology.
+func getTopologyDiff(w http.ResponseWriter, r *http.Request) {
+	if snapshots == nil {
+		http.Error(w, "Topology snapshots are disabled", http.StatusServiceUnavailable)
+		return
+	}
+	diff, err := snapshots.diff(r.URL.Query().Get("from"), r.URL.Query().Get("to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diff)
+}
+
+// diff resolves and compares two snapshots, see getTopologyDiff
+func (s *snapshotStore) diff(fromValue, toValue string) (*TopologyDiff, error) {
+	if toValue == "" {
+		toValue = "now"
+	}
+	var from *TopologySnapshot
+	var err error
+	if fromValue == "" {
+		if from, err = s.latest(); err == nil && from == nil {
+			err = fmt.Errorf("no snapshots yet")
+		}
+	} else {
+		from, err = s.resolve(fromValue)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("from: %w", err)
+	}
+	to, err := s.resolve(toValue)
+	if err != nil {
+		return nil, fmt.Errorf("to: %w", err)
+	}
+	return topologyDiff(from, to), nil
+}
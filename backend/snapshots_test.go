@@ -0,0 +1,107 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// The kmsg test topology after a few changes: the FTDI moved to the second child
+// hub and another one with its VID:PID took its port, the SanDisk is gone, the
+// Logitech reconnected at low speed and an identical one was plugged in
+const diffTestTree = `/:  Bus 001.Port 001: Dev 001, Class=root_hub, Driver=xhci_hcd/4p, 480M
+    |__ Port 003: Dev 009, If 0, Class=Hub, Driver=hub/7p, 480M
+        |__ Port 001: Dev 010, If 0, Class=Hub, Driver=hub/4p, 480M
+            |__ Port 002: Dev 030, If 0, Class=Vendor Specific Class, Driver=ftdi_sio, 12M
+            |__ Port 004: Dev 032, If 0, Class=Human Interface Device, Driver=usbhid, 12M
+        |__ Port 002: Dev 011, If 0, Class=Hub, Driver=hub/4p, 480M
+            |__ Port 001: Dev 031, If 0, Class=Vendor Specific Class, Driver=ftdi_sio, 480M
+        |__ Port 005: Dev 012, If 0, Class=Human Interface Device, Driver=usbhid, 1.5M
+`
+
+const diffTestList = `Bus 001 Device 001: ID 1d6b:0002 Linux Foundation 2.0 root hub
+Bus 001 Device 009: ID 1a40:0201 Terminus Technology Inc. FE 2.1 7-port Hub
+Bus 001 Device 010: ID 1a40:0101 Terminus Technology Inc. Hub
+Bus 001 Device 011: ID 1a40:0101 Terminus Technology Inc. Hub
+Bus 001 Device 030: ID 0403:6001 FTDI FT232
+Bus 001 Device 031: ID 0403:6001 FTDI FT232
+Bus 001 Device 032: ID 046d:c52b Logitech Receiver
+Bus 001 Device 012: ID 046d:c52b Logitech Receiver
+`
+
+// diffTestSnapshot parses a topology, sets device serials and port power states by port ID
+func diffTestSnapshot(t *testing.T, tree, list string, serials map[string]string, powered map[string]bool) *TopologySnapshot {
+	t.Helper()
+	raw := parseTreeOutput(tree, parseDeviceList(list))
+	for portID, serial := range serials {
+		device := findPortDevice(raw, portID)
+		if device == nil {
+			t.Fatalf("no device on %s", portID)
+		}
+		device.Serial = serial
+	}
+	walkPorts(raw, func(bus int, path string, port *USBPort) {
+		if on, ok := powered[sysfsName(bus, path)]; ok {
+			port.Powered = &on
+		}
+	})
+	return &TopologySnapshot{Topology: raw}
+}
+
+func TestTopologyDiff(t *testing.T) {
+	saved := config.Hubs
+	defer func() { config.Hubs = saved }()
+	config.Hubs = []HubConfig{{VendorID: "1a40", ProductID: "0201", Name: "Test Hub", PortMap: map[string]int{"1.2": 7}}}
+
+	from := diffTestSnapshot(t, kmsgTestTree, kmsgTestList,
+		map[string]string{"1-3.1.2": "A"},
+		map[string]bool{"1-3.1.4": true, "1-3.2.3": true, "1-3.2.4": false})
+	to := diffTestSnapshot(t, diffTestTree, diffTestList,
+		map[string]string{"1-3.2.1": "A", "1-3.1.2": "B"},
+		map[string]bool{"1-3.1.4": false, "1-3.2.3": true, "1-3.2.4": true, "1-3.2.2": false})
+	diff := topologyDiff(from, to)
+
+	portIDs := func(devices []SnapshotDevice) []string {
+		ids := []string{}
+		for _, d := range devices {
+			ids = append(ids, d.PortID)
+		}
+		return ids
+	}
+
+	// Same VID:PID with another serial is another device; an identical serial-less
+	// device next to one that stayed is new
+	if got, want := portIDs(diff.Added), []string{"1-3.1.2", "1-3.1.4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("added %v, want %v", got, want)
+	}
+	if got, want := portIDs(diff.Removed), []string{"1-3.1.3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("removed %v, want %v", got, want)
+	}
+
+	if len(diff.Moved) != 1 {
+		t.Fatalf("moved %+v, want one device", diff.Moved)
+	}
+	move := diff.Moved[0]
+	if move.PortID != "1-3.2.1" || move.FromPortID != "1-3.1.2" || move.Serial != "A" {
+		t.Errorf("moved %s from %s, want serial A from 1-3.1.2 to 1-3.2.1", move.PortID, move.FromPortID)
+	}
+	if move.FromMappedPort != 7 || move.FromHubName != "Test Hub" {
+		t.Errorf("moved from %s port %d, want Test Hub port 7", move.FromHubName, move.FromMappedPort)
+	}
+	if move.FromSpeed != "12M" || move.Speed != "480M" {
+		t.Errorf("moved at %s, from %s, want 480M from 12M", move.Speed, move.FromSpeed)
+	}
+
+	if len(diff.SpeedChanged) != 1 || diff.SpeedChanged[0].PortID != "1-3.5" ||
+		diff.SpeedChanged[0].FromSpeed != "12M" || diff.SpeedChanged[0].Speed != "1.5M" {
+		t.Errorf("speed changed %+v, want 1-3.5 from 12M to 1.5M", diff.SpeedChanged)
+	}
+
+	// Only ports known in both snapshots; unmapped ports get the free mapped port numbers
+	want := []PowerChange{
+		{PortID: "1-3.1.4", HubName: "Test Hub", MappedPort: 3, From: true, To: false},
+		{PortID: "1-3.2.4", HubName: "Test Hub", MappedPort: 8, From: false, To: true},
+	}
+	if !reflect.DeepEqual(diff.PowerChanged, want) {
+		t.Errorf("power changed %+v, want %+v", diff.PowerChanged, want)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// sysfsRoot is where the kernel exposes USB device attributes
+var sysfsRoot = "/sys/bus/usb/devices"
+
+// sysfsName returns the kernel device name for a device at the given USB path,
+// e.g. "usb1" for the root hub of bus 1 and "1-3.2" for a device behind it
+func sysfsName(bus int, path string) string {
+	if path == "" {
+		return fmt.Sprintf("usb%d", bus)
+	}
+	return fmt.Sprintf("%d-%s", bus, path)
+}
+
+// readSysfsAttr reads a single sysfs attribute of a USB device, or "" if unavailable
+func readSysfsAttr(name, attr string) string {
+	data, err := os.ReadFile(filepath.Join(sysfsRoot, name, attr))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// enrichFromSysfs fills in descriptor details that lsusb -t doesn't report
+func enrichFromSysfs(topology *USBTopology) {
+	walkDevices(topology, func(bus int, path string, depth int, device *USBDevice) {
+		name := sysfsName(bus, path)
+
+		// bMaxPower is reported as e.g. "500mA"
+		if maxPower := readSysfsAttr(name, "bMaxPower"); maxPower != "" {
+			device.MaxPowerMA, _ = strconv.Atoi(strings.TrimSuffix(maxPower, "mA"))
+		}
+
+		// Bit 6 of bmAttributes marks a self-powered configuration
+		if attrs := readSysfsAttr(name, "bmAttributes"); attrs != "" {
+			if v, err := strconv.ParseUint(attrs, 16, 8); err == nil {
+				device.SelfPowered = v&0x40 != 0
+			}
+		}
+
+		// bcdUSB of the device descriptor, e.g. "2.10"
+		device.USBVersion = readSysfsAttr(name, "version")
+		device.Serial = readSysfsAttr(name, "serial")
+		device.Manufacturer = readSysfsAttr(name, "manufacturer")
+		device.Product = readSysfsAttr(name, "product")
+	})
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSConfig configures HTTPS and client certificate authentication
+type TLSConfig struct {
+	CertFile     string             `toml:"cert_file"` // TLS is enabled when both files are set
+	KeyFile      string             `toml:"key_file"`
+	ClientCAFile string             `toml:"client_ca_file"` // CA bundle to verify client certificates against
+	ClientAuth   string             `toml:"client_auth"`    // "optional" (default) or "require"
+	Clients      []ClientCertConfig `toml:"clients"`
+}
+
+// ClientCertConfig grants a client certificate the permissions of an API token
+type ClientCertConfig struct {
+	Subject    string   `toml:"subject"`     // Full subject, e.g. "CN=ci-runner,OU=CI,O=Lab"
+	CommonName string   `toml:"common_name"` // Or just the common name
+	Name       string   `toml:"name"`        // Name in sources, ownership and leases; default the common name
+	Scope      string   `toml:"scope"`       // "read", "power" or "admin"
+	Roles      []string `toml:"roles"`
+}
+
+const certReloadInterval = 10 * time.Second
+
+// certReloader serves the configured certificate and reloads it when the files change
+type certReloader struct {
+	certFile, keyFile string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	modified time.Time
+}
+
+// serverTLSConfig returns the TLS configuration of the server, or nil if TLS is off
+func serverTLSConfig() (*tls.Config, error) {
+	cfg := config.TLS
+	if cfg.CertFile == "" && cfg.KeyFile == "" {
+		if cfg.ClientCAFile != "" || len(cfg.Clients) > 0 {
+			log.Println("Warning: Client certificates are configured but TLS is not, ignoring them")
+		}
+		return nil, nil
+	}
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, fmt.Errorf("both cert_file and key_file are required for TLS")
+	}
+
+	reloader := &certReloader{certFile: cfg.CertFile, keyFile: cfg.KeyFile}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+	go reloader.watch()
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.getCertificate,
+	}
+
+	if cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+
+		switch cfg.ClientAuth {
+		case "", "optional":
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		case "require":
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		default:
+			return nil, fmt.Errorf("unknown client_auth %q, expected \"optional\" or \"require\"", cfg.ClientAuth)
+		}
+	} else if len(cfg.Clients) > 0 {
+		log.Println("Warning: TLS clients are configured without client_ca_file, ignoring them")
+	}
+
+	return tlsConfig, nil
+}
+
+// load reads the certificate and key
+func (c *certReloader) load() error {
+	modified := c.modTime()
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading certificate: %w", err)
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.modified = modified
+	c.mu.Unlock()
+	return nil
+}
+
+// modTime returns the latest modification time of the certificate and key files
+func (c *certReloader) modTime() time.Time {
+	var latest time.Time
+	for _, path := range []string{c.certFile, c.keyFile} {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// watch reloads the certificate when its files change, e.g. after renewal. A
+// certificate that fails to load is retried on the next change and the old one
+// stays in use.
+func (c *certReloader) watch() {
+	for {
+		time.Sleep(certReloadInterval)
+
+		modified := c.modTime()
+		c.mu.RLock()
+		changed := modified.After(c.modified)
+		c.mu.RUnlock()
+		if !changed {
+			continue
+		}
+
+		if err := c.load(); err != nil {
+			log.Printf("Warning: Failed to reload TLS certificate: %v", err)
+			c.mu.Lock()
+			c.modified = modified
+			c.mu.Unlock()
+			continue
+		}
+		log.Printf("Reloaded TLS certificate from %s", c.certFile)
+	}
+}
+
+// getCertificate returns the current certificate for a handshake
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// clientCerts holds the client certificate identities from the config
+var clientCerts []ClientCertConfig
+
+// loadClientCerts validates the configured client certificate identities
+func loadClientCerts() {
+	if config.TLS.CertFile == "" || config.TLS.KeyFile == "" || config.TLS.ClientCAFile == "" {
+		return
+	}
+	for i, c := range config.TLS.Clients {
+		switch {
+		case c.Subject == "" && c.CommonName == "":
+			log.Printf("Warning: TLS client %d has neither subject nor common_name, skipping", i+1)
+		case c.Scope != ScopeRead && c.Scope != ScopePower && c.Scope != ScopeAdmin:
+			log.Printf("Warning: TLS client %d has unknown scope %q, skipping", i+1, c.Scope)
+		default:
+			clientCerts = append(clientCerts, c)
+		}
+	}
+	if len(clientCerts) > 0 {
+		log.Printf("Client certificate authentication enabled for %d subject(s)", len(clientCerts))
+	}
+}
+
+// clientCertToken returns the permissions of the verified client certificate of a
+// request as a token
+func clientCertToken(r *http.Request) (APIToken, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return APIToken{}, false
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject
+
+	for _, c := range clientCerts {
+		if (c.Subject != "" && c.Subject != subject.String()) ||
+			(c.CommonName != "" && c.CommonName != subject.CommonName) {
+			continue
+		}
+		name := c.Name
+		if name == "" {
+			name = subject.CommonName
+		}
+		return APIToken{Name: name, Scope: c.Scope, Roles: c.Roles}, true
+	}
+	return APIToken{}, false
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/term"
+)
+
+const (
+	tuiCellWidth     = 6
+	tuiDefaultRowLen = 10 // Ports per row of hubs without a grid_layout
+	tuiRefreshDelay  = 300 * time.Millisecond
+	tuiRetryInterval = 5 * time.Second
+)
+
+// ANSI escape sequences
+const (
+	ansiReset   = "\x1b[0m"
+	ansiBold    = "\x1b[1m"
+	ansiDim     = "\x1b[2m"
+	ansiReverse = "\x1b[7m"
+	ansiRed     = "\x1b[31m"
+	ansiGreen   = "\x1b[32m"
+	ansiYellow  = "\x1b[33m"
+)
+
+// tuiHub is a hub as drawn by the TUI: its ports arranged in rows, nil for a gap
+type tuiHub struct {
+	name string
+	rows [][]*tuiCell
+}
+
+// tuiCell is a port in the grid
+type tuiCell struct {
+	label string // Mapped port, port key or port number
+	port  cliPort
+}
+
+// tuiKey is a key press
+type tuiKey int
+
+const (
+	keyUp tuiKey = iota + 1
+	keyDown
+	keyLeft
+	keyRight
+	keyTab
+	keyOn
+	keyOff
+	keyCycle
+	keyRefresh
+	keyQuit
+)
+
+// tui is the state of the terminal UI
+type tui struct {
+	backend cliBackend
+	hubs    []tuiHub
+	hub     int // Selected hub
+	row     int // Selected cell in the hub's rows
+	col     int
+	status  string
+	width   int
+	height  int
+}
+
+// runTUI shows the hub grid until the user quits
+func (c *cli) runTUI(args []string) error {
+	if len(args) > 0 {
+		return errCLIUsage
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return fmt.Errorf("tui needs a terminal")
+	}
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	// Alternate screen without cursor, restored on exit
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer func() {
+		fmt.Print("\x1b[?25h\x1b[?1049l")
+		term.Restore(fd, state)
+	}()
+
+	t := &tui{backend: c.backend, status: "Loading..."}
+	keys := make(chan tuiKey)
+	go readTUIKeys(keys)
+	resize := make(chan os.Signal, 1)
+	signal.Notify(resize, syscall.SIGWINCH)
+
+	// Refresh on events, coalescing bursts such as a hub re-enumerating
+	changed := make(chan string, 1)
+	go t.followEvents(changed)
+
+	type scanResult struct {
+		topology *USBTopology
+		err      error
+	}
+	scans := make(chan scanResult, 1)
+	refresh := func() {
+		go func() {
+			topology, err := t.backend.topology(true)
+			scans <- scanResult{topology, err}
+		}()
+	}
+	refresh()
+
+	var pending <-chan time.Time
+	results := make(chan string, 1)
+	for {
+		t.width, t.height, _ = term.GetSize(fd)
+		t.draw()
+
+		select {
+		case key := <-keys:
+			switch key {
+			case keyQuit:
+				return nil
+			case keyRefresh:
+				refresh()
+			case keyOn, keyOff, keyCycle:
+				action := map[tuiKey]string{keyOn: "on", keyOff: "off", keyCycle: "cycle"}[key]
+				if cell := t.selected(); cell != nil {
+					t.status = fmt.Sprintf("Switching %s %s...", cell.port.Name, action)
+					go func(p cliPort) {
+						if _, err := t.backend.power(p.PortID, action, c.lease); err != nil {
+							results <- fmt.Sprintf("%s %s failed: %v", p.Name, action, err)
+						} else {
+							results <- fmt.Sprintf("%s switched %s", p.Name, action)
+						}
+					}(cell.port)
+				}
+			default:
+				t.move(key)
+			}
+		case message := <-results:
+			t.status = message
+			refresh()
+		case message := <-changed:
+			if message != "" {
+				t.status = message
+			}
+			if pending == nil {
+				pending = time.After(tuiRefreshDelay)
+			}
+		case <-pending:
+			pending = nil
+			refresh()
+		case scan := <-scans:
+			if scan.err != nil {
+				t.status = "Scan failed: " + scan.err.Error()
+			} else {
+				t.update(scan.topology)
+				if t.status == "Loading..." {
+					t.status = ""
+				}
+			}
+		case <-resize:
+		}
+	}
+}
+
+// followEvents reports port events as status messages, reconnecting when the stream ends
+func (t *tui) followEvents(changed chan<- string) {
+	for {
+		err := t.backend.watch(nil, nil, func(event PortEvent) {
+			message := fmt.Sprintf("%s %s %s", event.Time.Local().Format("15:04:05"), event.Type, event.PortID)
+			if label := cliPortLabel(event.HubName, &USBPort{MappedPort: event.MappedPort, PortKey: event.PortKey}); label != "" {
+				message = fmt.Sprintf("%s %s %s", event.Time.Local().Format("15:04:05"), event.Type, label)
+			}
+			select {
+			case changed <- message:
+			default:
+			}
+		})
+		select {
+		case changed <- fmt.Sprintf("Event stream: %v", err):
+		default:
+		}
+		time.Sleep(tuiRetryInterval)
+	}
+}
+
+// readTUIKeys reads key presses from the terminal
+func readTUIKeys(keys chan<- tuiKey) {
+	buf := make([]byte, 16)
+	var pending string // Start of an escape sequence split across reads
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			keys <- keyQuit
+			return
+		}
+		input := pending + string(buf[:n])
+		pending = ""
+		for input != "" {
+			key, size := parseTUIKey(input)
+			if size == 0 {
+				pending = input
+				break
+			}
+			if key != 0 {
+				keys <- key
+			}
+			input = input[size:]
+		}
+	}
+}
+
+// parseTUIKey returns the key at the start of the input and how many bytes it
+// takes, 0 if the input is an incomplete escape sequence. Unknown input is
+// skipped with key 0; a lone Esc is ignored, as it may be the start of an arrow
+// key whose rest comes with the next read.
+func parseTUIKey(input string) (tuiKey, int) {
+	if input[0] == '\x1b' {
+		if len(input) == 1 || input == "\x1b[" {
+			return 0, 0
+		}
+		if input[1] != '[' {
+			return 0, 1
+		}
+		// CSI sequence: parameters, then a final byte in 0x40-0x7e
+		end := 2
+		for end < len(input) && (input[end] < 0x40 || input[end] > 0x7e) {
+			end++
+		}
+		if end == len(input) {
+			return 0, 0
+		}
+		switch input[2 : end+1] {
+		case "A":
+			return keyUp, end + 1
+		case "B":
+			return keyDown, end + 1
+		case "D":
+			return keyLeft, end + 1
+		case "C":
+			return keyRight, end + 1
+		}
+		return 0, end + 1
+	}
+
+	switch input[0] {
+	case 'k':
+		return keyUp, 1
+	case 'j':
+		return keyDown, 1
+	case 'h':
+		return keyLeft, 1
+	case 'l':
+		return keyRight, 1
+	case '\t':
+		return keyTab, 1
+	case 'o', '1':
+		return keyOn, 1
+	case 'f', '0':
+		return keyOff, 1
+	case 'c':
+		return keyCycle, 1
+	case 'r':
+		return keyRefresh, 1
+	case 'q', '\x03':
+		return keyQuit, 1
+	}
+	return 0, 1
+}
+
+// update rebuilds the hubs from a new topology, keeping the selection on the same port
+func (t *tui) update(aggregated *USBTopology) {
+	var selectedID string
+	if cell := t.selected(); cell != nil {
+		selectedID = cell.port.PortID
+	}
+
+	t.hubs = tuiHubs(aggregated)
+	if t.hub >= len(t.hubs) {
+		t.hub = 0
+	}
+	for h, hub := range t.hubs {
+		for r, row := range hub.rows {
+			for c, cell := range row {
+				if cell != nil && cell.port.PortID == selectedID {
+					t.hub, t.row, t.col = h, r, c
+					return
+				}
+			}
+		}
+	}
+	if t.selected() == nil {
+		t.row, t.col = 0, 0
+		t.move(keyRight)
+	}
+}
+
+// tuiHubs arranges the ports of all external hubs: aggregated hubs by their
+// grid_layout or mapped port order, other hubs by port number
+func tuiHubs(aggregated *USBTopology) []tuiHub {
+	var hubs []tuiHub
+	walkDevices(aggregated, func(bus int, path string, depth int, device *USBDevice) {
+		if !device.Aggregated && (path == "" || !isHub(device)) {
+			return
+		}
+
+		hub := tuiHub{name: fmt.Sprintf("%s (%s)", hubDisplayName(device), sysfsName(bus, path))}
+		hubName := ""
+		if device.Aggregated {
+			hub.name = hubDisplayName(device)
+			hubName = hub.name
+		}
+		for _, gridRow := range hubGrid(device, bus, path, tuiDefaultRowLen) {
+			row := make([]*tuiCell, len(gridRow))
+			for i, cell := range gridRow {
+				if cell != nil {
+					row[i] = &tuiCell{label: cell.Label, port: newCLIPort(hubName, cell.PortID, cell.Port)}
+				}
+			}
+			hub.rows = append(hub.rows, row)
+		}
+		hubs = append(hubs, hub)
+	})
+	return hubs
+}
+
+// selected returns the selected cell, or nil
+func (t *tui) selected() *tuiCell {
+	if t.hub >= len(t.hubs) {
+		return nil
+	}
+	rows := t.hubs[t.hub].rows
+	if t.row >= len(rows) || t.col >= len(rows[t.row]) {
+		return nil
+	}
+	return rows[t.row][t.col]
+}
+
+// move changes the selection, skipping gaps in the grid
+func (t *tui) move(key tuiKey) {
+	if len(t.hubs) == 0 {
+		return
+	}
+	if key == keyTab {
+		t.hub = (t.hub + 1) % len(t.hubs)
+		t.row, t.col = 0, 0
+		if t.selected() == nil {
+			t.move(keyRight)
+		}
+		return
+	}
+
+	rows := t.hubs[t.hub].rows
+	switch key {
+	case keyLeft, keyRight:
+		// Walk the cells in reading order
+		var order [][2]int
+		for r, row := range rows {
+			for c, cell := range row {
+				if cell != nil {
+					order = append(order, [2]int{r, c})
+				}
+			}
+		}
+		if len(order) == 0 {
+			return
+		}
+		current := -1
+		for i, pos := range order {
+			if pos == [2]int{t.row, t.col} {
+				current = i
+			}
+		}
+		next := 0
+		switch {
+		case current < 0:
+		case key == keyRight:
+			next = (current + 1) % len(order)
+		default:
+			next = (current - 1 + len(order)) % len(order)
+		}
+		t.row, t.col = order[next][0], order[next][1]
+	case keyUp, keyDown:
+		step := 1
+		if key == keyUp {
+			step = -1
+		}
+		for r := t.row + step; r >= 0 && r < len(rows); r += step {
+			// The nearest cell in that row
+			best := -1
+			for c, cell := range rows[r] {
+				if cell != nil && (best < 0 || abs(c-t.col) < abs(best-t.col)) {
+					best = c
+				}
+			}
+			if best >= 0 {
+				t.row, t.col = r, best
+				return
+			}
+		}
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// cellStyle returns the color and marker of a port: faulted, powered off, occupied or empty
+func cellStyle(port *USBPort) (string, string) {
+	switch {
+	case port.Errors != nil && port.Errors.OverCurrent > 0:
+		return ansiRed + ansiBold, "!"
+	case port.Powered != nil && !*port.Powered:
+		return ansiDim, "off"
+	case port.Errors != nil && port.Errors.EnumErrors > 0:
+		return ansiYellow + ansiBold, "?"
+	case port.Device != nil:
+		return ansiGreen + ansiBold, "#"
+	default:
+		return "", "."
+	}
+}
+
+// draw renders the screen
+func (t *tui) draw() {
+	var b bytes.Buffer
+	lines := 0
+	line := func(format string, args ...interface{}) {
+		if t.height > 0 && lines >= t.height-1 {
+			return
+		}
+		fmt.Fprintf(&b, format, args...)
+		b.WriteString(ansiReset + "\x1b[K\r\n")
+		lines++
+	}
+
+	b.WriteString("\x1b[H")
+	line(ansiBold + "hubcontrol" + ansiReset + "  arrows/hjkl move, tab next hub, o on, f off, c cycle, r refresh, q quit")
+	line("")
+	if len(t.hubs) == 0 {
+		line("No hubs found")
+	}
+
+	for h, hub := range t.hubs {
+		title := hub.name
+		if h == t.hub {
+			title = ansiReverse + " " + title + " "
+		}
+		line(ansiBold + title)
+		for r, row := range hub.rows {
+			var labels, markers strings.Builder
+			for c, cell := range row {
+				if cell == nil {
+					labels.WriteString(strings.Repeat(" ", tuiCellWidth))
+					markers.WriteString(strings.Repeat(" ", tuiCellWidth))
+					continue
+				}
+				color, marker := cellStyle(cell.port.port)
+				if h == t.hub && r == t.row && c == t.col {
+					color += ansiReverse
+				}
+				fmt.Fprintf(&labels, "%s%s%s ", color, tuiCenter(cell.label, tuiCellWidth-1), ansiReset)
+				fmt.Fprintf(&markers, "%s%s%s ", color, tuiCenter(marker, tuiCellWidth-1), ansiReset)
+			}
+			line("  %s", labels.String())
+			line("  %s", markers.String())
+		}
+		line("")
+	}
+
+	line(ansiGreen+ansiBold+"#"+ansiReset+" device  . empty  %soff%s powered off  %s!%s over-current  %s?%s enumeration errors",
+		ansiDim, ansiReset, ansiRed+ansiBold, ansiReset, ansiYellow+ansiBold, ansiReset)
+	line("")
+	if cell := t.selected(); cell != nil {
+		t.drawDetails(line, cell)
+	}
+
+	// Clear the rest and put the status on the last line
+	b.WriteString("\x1b[J")
+	if t.height > 0 {
+		fmt.Fprintf(&b, "\x1b[%d;1H", t.height)
+	}
+	b.WriteString(tuiTruncate(t.status, t.width))
+	os.Stdout.Write(b.Bytes())
+}
+
+// drawDetails prints the selected port's details
+func (t *tui) drawDetails(line func(string, ...interface{}), cell *tuiCell) {
+	p, port := cell.port, cell.port.port
+	line(ansiBold+"%s"+ansiReset+"  %s", p.Name, p.PortID)
+	if d := port.Device; d != nil {
+		device := fmt.Sprintf("%s:%s %s", d.VendorID, d.ProductID, d.Name)
+		if d.Serial != "" {
+			device += "  serial " + d.Serial
+		}
+		line("  Device:  %s", tuiTruncate(device, t.width-11))
+	} else {
+		line("  Device:  none")
+	}
+	switch {
+	case port.Powered == nil:
+		line("  Power:   unknown")
+	case *port.Powered:
+		line("  Power:   on")
+	default:
+		line("  Power:   off")
+	}
+	if e := port.Errors; e != nil && (e.OverCurrent > 0 || e.EnumErrors > 0) {
+		line("  Errors:  %d over-current, %d enumeration, last: %s", e.OverCurrent, e.EnumErrors, tuiTruncate(e.LastMessage, t.width-50))
+	}
+	if l := port.Lease; l != nil {
+		line("  Leased:  by %s until %s", l.Owner, l.Expires.Local().Format("15:04"))
+	}
+	if port.CanControl != nil && !*port.CanControl {
+		line("  Control: not allowed")
+	}
+}
+
+// tuiCenter centers text in a field of the given width
+func tuiCenter(text string, width int) string {
+	if len(text) >= width {
+		return text[:width]
+	}
+	left := (width - len(text)) / 2
+	return strings.Repeat(" ", left) + text + strings.Repeat(" ", width-len(text)-left)
+}
+
+// tuiTruncate shortens text to fit the width
+func tuiTruncate(text string, width int) string {
+	if width > 0 && len(text) > width {
+		return text[:width]
+	}
+	return text
+}
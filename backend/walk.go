@@ -0,0 +1,56 @@
+package main
+
+import "fmt"
+
+// joinPortPath appends a port number to a USB port path (e.g. "3.1" + 2 = "3.1.2")
+func joinPortPath(parentPath string, port int) string {
+	if parentPath == "" {
+		return fmt.Sprintf("%d", port)
+	}
+	return fmt.Sprintf("%s.%d", parentPath, port)
+}
+
+// walkDevices calls fn for every device in the topology with its bus number, its USB
+// port path ("" for the root hub) and its tier depth below the root hub.
+// Aggregated hubs are descended through their PhysicalPorts.
+func walkDevices(topology *USBTopology, fn func(bus int, path string, depth int, device *USBDevice)) {
+	for _, b := range topology.Buses {
+		walkDevice(b.Device, b.Bus, "", 0, fn)
+	}
+}
+
+func walkDevice(device *USBDevice, bus int, path string, depth int, fn func(bus int, path string, depth int, device *USBDevice)) {
+	if device == nil {
+		return
+	}
+	fn(bus, path, depth, device)
+	walkDevicePorts(device, bus, path, func(portPath string, port *USBPort) {
+		walkDevice(port.Device, bus, portPath, depth+1, fn)
+	})
+}
+
+// walkPorts calls fn for every port in the topology with its bus number and USB port path
+func walkPorts(topology *USBTopology, fn func(bus int, path string, port *USBPort)) {
+	walkDevices(topology, func(bus int, path string, depth int, device *USBDevice) {
+		walkDevicePorts(device, bus, path, func(portPath string, port *USBPort) {
+			fn(bus, portPath, port)
+		})
+	})
+}
+
+// walkDevicePorts calls fn for each direct port of a device. For aggregated hubs the
+// flattened PhysicalPorts are used, which carry their own Location.
+func walkDevicePorts(device *USBDevice, bus int, path string, fn func(portPath string, port *USBPort)) {
+	ports := device.Ports
+	if device.Aggregated {
+		ports = device.PhysicalPorts
+	}
+	for i := range ports {
+		port := &ports[i]
+		portPath := port.Location
+		if portPath == "" {
+			portPath = joinPortPath(path, port.Port)
+		}
+		fn(portPath, port)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WatchdogConfig declares a device expected on a port, which is power-cycled
+// when the device goes missing
+type WatchdogConfig struct {
+	Name string `toml:"name"`
+	PortSelector
+	VendorID   string `toml:"vendor_id"`
+	ProductID  string `toml:"product_id"`
+	Serial     string `toml:"serial"`      // Optional, matched if set
+	MissingFor string `toml:"missing_for"` // How long the device must be missing before recovery, e.g. "30s"
+	Backoff    string `toml:"backoff"`     // Delay after the first attempt, doubled for each further attempt
+	MaxBackoff string `toml:"max_backoff"` // Upper bound for the delay between attempts
+	MaxRetries *int   `toml:"max_retries"` // Attempts before giving up until the device returns; default 5, 0 never power-cycles, -1 never gives up
+}
+
+const (
+	defaultWatchdogMissingFor = 30 * time.Second
+	defaultWatchdogBackoff    = time.Minute
+	defaultWatchdogMaxBackoff = 30 * time.Minute
+	defaultWatchdogMaxRetries = 5
+	watchdogCheckInterval     = time.Second
+)
+
+// WatchdogStatus is the runtime state of a watchdog
+type WatchdogStatus struct {
+	Name         string     `json:"name"`
+	Port         string     `json:"port"`             // Selector as configured
+	PortID       string     `json:"portId,omitempty"` // Resolved port, empty if it can't be found
+	Device       string     `json:"device"`           // Expected VID:PID
+	Present      bool       `json:"present"`
+	MissingSince *time.Time `json:"missingSince,omitempty"`
+	Attempts     int        `json:"attempts"`
+	NextAttempt  *time.Time `json:"nextAttempt,omitempty"`
+	GaveUp       bool       `json:"gaveUp"`
+	LastError    string     `json:"lastError,omitempty"`
+}
+
+// watchdog tracks one expected device
+type watchdog struct {
+	cfg        WatchdogConfig
+	missingFor time.Duration
+	backoff    time.Duration
+	maxBackoff time.Duration
+	maxRetries int // Negative retries forever
+
+	mu     sync.Mutex
+	status WatchdogStatus
+}
+
+var watchdogs []*watchdog
+
+// startWatchdogs starts checking the configured watchdogs against the monitored topology
+func startWatchdogs() {
+	for i, cfg := range config.Watchdog {
+		if cfg.Name == "" {
+			cfg.Name = fmt.Sprintf("watchdog-%d", i+1)
+		}
+		if cfg.VendorID == "" || cfg.ProductID == "" {
+			log.Printf("Warning: Watchdog %s: vendor_id and product_id are required, skipping", cfg.Name)
+			continue
+		}
+
+		wd := &watchdog{
+			cfg:        cfg,
+			missingFor: parseConfigDuration("missing_for of watchdog "+cfg.Name, cfg.MissingFor, defaultWatchdogMissingFor),
+			backoff:    parseConfigDuration("backoff of watchdog "+cfg.Name, cfg.Backoff, defaultWatchdogBackoff),
+			maxBackoff: parseConfigDuration("max_backoff of watchdog "+cfg.Name, cfg.MaxBackoff, defaultWatchdogMaxBackoff),
+			maxRetries: defaultWatchdogMaxRetries,
+		}
+		if cfg.MaxRetries != nil {
+			if *cfg.MaxRetries >= -1 {
+				wd.maxRetries = *cfg.MaxRetries
+			} else {
+				log.Printf("Warning: Watchdog %s: invalid max_retries %d, using %d", cfg.Name, *cfg.MaxRetries, defaultWatchdogMaxRetries)
+			}
+		}
+		wd.status = WatchdogStatus{
+			Name:   cfg.Name,
+			Port:   cfg.PortSelector.String(),
+			Device: cfg.VendorID + ":" + cfg.ProductID,
+		}
+		watchdogs = append(watchdogs, wd)
+	}
+
+	if len(watchdogs) == 0 {
+		return
+	}
+	log.Printf("Watching %d expected device(s)", len(watchdogs))
+
+	go func() {
+		for {
+			raw, aggregated := monitor.snapshot()
+			if raw != nil {
+				for _, wd := range watchdogs {
+					wd.check(raw, aggregated, time.Now())
+				}
+			}
+			time.Sleep(watchdogCheckInterval)
+		}
+	}()
+}
+
+// matches reports whether a device is the one this watchdog expects
+func (wd *watchdog) matches(device *USBDevice) bool {
+	if device == nil {
+		return false
+	}
+	return strings.EqualFold(device.VendorID, wd.cfg.VendorID) &&
+		strings.EqualFold(device.ProductID, wd.cfg.ProductID) &&
+		(wd.cfg.Serial == "" || device.Serial == wd.cfg.Serial)
+}
+
+// check compares the port against the expected device and power-cycles it when
+// the device has been missing long enough and the back-off allows another attempt
+func (wd *watchdog) check(raw, aggregated *USBTopology, now time.Time) {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+
+	portID, err := resolvePort(aggregated, wd.cfg.PortSelector)
+	if err != nil {
+		wd.status.PortID = ""
+		wd.status.LastError = err.Error()
+		return
+	}
+	wd.status.PortID = portID
+
+	if wd.matches(findPortDevice(raw, portID)) {
+		if wd.status.Attempts > 0 {
+			wd.publish(EventRecovered, portID, fmt.Sprintf("device back after %d recovery attempt(s)", wd.status.Attempts))
+		}
+		wd.status = WatchdogStatus{
+			Name:    wd.status.Name,
+			Port:    wd.status.Port,
+			PortID:  portID,
+			Device:  wd.status.Device,
+			Present: true,
+		}
+		return
+	}
+
+	wd.status.Present = false
+	// A port switched off on purpose isn't missing its device
+	if powered, known := portPower.powered(portID); known && !powered {
+		wd.status.MissingSince = nil
+		return
+	}
+	if wd.status.MissingSince == nil {
+		since := now
+		wd.status.MissingSince = &since
+	}
+	if wd.status.GaveUp || now.Sub(*wd.status.MissingSince) < wd.missingFor {
+		return
+	}
+	if wd.status.NextAttempt != nil && now.Before(*wd.status.NextAttempt) {
+		return
+	}
+
+	if wd.maxRetries >= 0 && wd.status.Attempts >= wd.maxRetries {
+		wd.status.GaveUp = true
+		wd.status.NextAttempt = nil
+		wd.publish(EventRecoveryGaveUp, portID, fmt.Sprintf("device still missing after %d attempt(s), giving up until it returns", wd.status.Attempts))
+		log.Printf("Watchdog %s: giving up on %s after %d attempt(s)", wd.cfg.Name, portID, wd.status.Attempts)
+		return
+	}
+
+	location, port, ok := uhubctlTarget(portID)
+	if !ok {
+		wd.status.LastError = fmt.Sprintf("cannot power control port %s", portID)
+		return
+	}
+
+	wd.status.Attempts++
+	next := now.Add(watchdogDelay(wd.backoff, wd.maxBackoff, wd.status.Attempts))
+	wd.status.NextAttempt = &next
+
+	attempt := fmt.Sprintf("attempt %d of %d", wd.status.Attempts, wd.maxRetries)
+	if wd.maxRetries < 0 {
+		attempt = fmt.Sprintf("attempt %d", wd.status.Attempts)
+	}
+	wd.publish(EventRecoveryAttempt, portID, fmt.Sprintf("device %s missing for %s, power-cycling (%s)",
+		wd.status.Device, now.Sub(*wd.status.MissingSince).Round(time.Second), attempt))
+	log.Printf("Watchdog %s: power-cycling %s (%s)", wd.cfg.Name, portID, attempt)
+
+	// Run uhubctl outside the lock, the cycle takes a few seconds
+	go func() {
+		output, err := setPortPower(location, port, "cycle", "watchdog:"+wd.cfg.Name)
+		if err != nil {
+			wd.mu.Lock()
+			wd.status.LastError = fmt.Sprintf("%v: %s", err, strings.TrimSpace(output))
+			wd.mu.Unlock()
+		}
+	}()
+}
+
+// watchdogDelay returns the delay after an attempt: backoff, doubled for each
+// attempt after the first, up to maxBackoff
+func watchdogDelay(backoff, maxBackoff time.Duration, attempts int) time.Duration {
+	delay := backoff
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		if delay > maxBackoff/2 {
+			return maxBackoff
+		}
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		return maxBackoff
+	}
+	return delay
+}
+
+// publish records a watchdog event for the port
+func (wd *watchdog) publish(eventType, portID, message string) {
+	bus, path, _ := splitPortID(portID)
+	publishEvent(PortEvent{
+		Type:      eventType,
+		PortID:    portID,
+		Bus:       bus,
+		Location:  path,
+		VendorID:  wd.cfg.VendorID,
+		ProductID: wd.cfg.ProductID,
+		Serial:    wd.cfg.Serial,
+		Source:    "watchdog:" + wd.cfg.Name,
+		Message:   message,
+	})
+}
+
+// getWatchdogStatus returns the state of all configured watchdogs
+func getWatchdogStatus(w http.ResponseWriter, r *http.Request) {
+	statuses := make([]WatchdogStatus, 0, len(watchdogs))
+	for _, wd := range watchdogs {
+		wd.mu.Lock()
+		statuses = append(statuses, wd.status)
+		wd.mu.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
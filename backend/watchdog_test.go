@@ -0,0 +1,27 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestWatchdogDelay(t *testing.T) {
+	tests := []struct {
+		backoff, maxBackoff time.Duration
+		attempts            int
+		want                time.Duration
+	}{
+		{time.Minute, 30 * time.Minute, 1, time.Minute},
+		{time.Minute, 30 * time.Minute, 3, 4 * time.Minute},
+		{time.Minute, 30 * time.Minute, 6, 30 * time.Minute},
+		{time.Minute, 30 * time.Minute, 100, 30 * time.Minute}, // Would overflow as a shift
+		{time.Hour, 30 * time.Minute, 1, 30 * time.Minute},
+		{time.Second, math.MaxInt64, 1000, math.MaxInt64},
+	}
+	for _, tt := range tests {
+		if got := watchdogDelay(tt.backoff, tt.maxBackoff, tt.attempts); got != tt.want {
+			t.Errorf("backoff %s, max %s, attempt %d: delay %s, want %s", tt.backoff, tt.maxBackoff, tt.attempts, got, tt.want)
+		}
+	}
+}
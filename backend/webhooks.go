@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// WebhookConfig is an HTTP endpoint that receives port events as JSON
+type WebhookConfig struct {
+	Name       string            `toml:"name" json:"name"`
+	URL        string            `toml:"url" json:"url"`
+	Events     []string          `toml:"events" json:"events,omitempty"` // Event types, "power" matches all power events; empty means all
+	Match      RuleMatch         `toml:"match" json:"match"`             // Port and device filters, as for rules
+	Secret     string            `toml:"secret" json:"-"`                // Signs the body with HMAC-SHA256 if set
+	Headers    map[string]string `toml:"headers" json:"-"`               // Extra request headers, e.g. for authentication
+	Timeout    string            `toml:"timeout" json:"timeout,omitempty"`
+	MaxRetries *int              `toml:"max_retries" json:"maxRetries"`    // Default 5; 0 never retries
+	Backoff    string            `toml:"backoff" json:"backoff,omitempty"` // Delay before the first retry, doubled for each further retry
+}
+
+const (
+	defaultWebhookTimeout    = 10 * time.Second
+	defaultWebhookMaxRetries = 5
+	defaultWebhookBackoff    = time.Second
+	maxWebhookBackoff        = 5 * time.Minute
+	webhookQueueSize         = 100
+	maxWebhookDeliveries     = 200
+)
+
+// WebhookPayload is the JSON body posted to webhook targets
+type WebhookPayload struct {
+	ID     string    `json:"id"` // Delivery ID, the same for all attempts
+	Target string    `json:"target"`
+	Rule   string    `json:"rule,omitempty"` // The rule that sent the event, if any
+	Event  PortEvent `json:"event"`
+}
+
+// WebhookDelivery records the delivery of one event to one target
+type WebhookDelivery struct {
+	ID         string     `json:"id"`
+	Target     string     `json:"target"`
+	EventType  string     `json:"eventType"`
+	PortID     string     `json:"portId,omitempty"`
+	Queued     time.Time  `json:"queued"`
+	Status     string     `json:"status"` // "pending", "delivered", "failed" or "dropped"
+	Attempts   int        `json:"attempts"`
+	StatusCode int        `json:"statusCode,omitempty"` // HTTP status of the last attempt
+	Error      string     `json:"error,omitempty"`      // Error of the last attempt
+	Finished   *time.Time `json:"finished,omitempty"`
+}
+
+// webhookTarget delivers events to one endpoint in order, one at a time
+type webhookTarget struct {
+	cfg        WebhookConfig
+	timeout    time.Duration
+	maxRetries int
+	backoff    time.Duration
+	queue      chan webhookJob
+}
+
+// webhookJob is a queued delivery with its encoded payload
+type webhookJob struct {
+	delivery *WebhookDelivery
+	body     []byte
+	attempts int
+	delay    time.Duration // Before the next retry
+}
+
+var (
+	webhookTargets    []*webhookTarget
+	webhookSeq        uint64
+	webhookDeliveries struct {
+		sync.Mutex
+		list []*WebhookDelivery
+	}
+	webhookResults = newCounter("hubcontrol_webhook_deliveries_total", "Webhook deliveries by target and final status.", "target", "status")
+)
+
+// newWebhookTarget sets up a target from its config, filling in defaults
+func newWebhookTarget(cfg WebhookConfig) *webhookTarget {
+	target := &webhookTarget{
+		cfg:        cfg,
+		timeout:    parseConfigDuration("timeout of webhook "+cfg.Name, cfg.Timeout, defaultWebhookTimeout),
+		backoff:    parseConfigDuration("backoff of webhook "+cfg.Name, cfg.Backoff, defaultWebhookBackoff),
+		maxRetries: defaultWebhookMaxRetries,
+		queue:      make(chan webhookJob, webhookQueueSize),
+	}
+	if cfg.MaxRetries != nil {
+		if *cfg.MaxRetries >= 0 {
+			target.maxRetries = *cfg.MaxRetries
+		} else {
+			log.Printf("Warning: Webhook %s: invalid max_retries %d, using %d", cfg.Name, *cfg.MaxRetries, defaultWebhookMaxRetries)
+		}
+	}
+	maxRetries := target.maxRetries
+	target.cfg.MaxRetries = &maxRetries
+	return target
+}
+
+// startWebhooks starts a delivery worker per configured target and subscribes them to port events
+func startWebhooks() {
+	for i, cfg := range config.Webhooks {
+		if cfg.Name == "" {
+			cfg.Name = fmt.Sprintf("webhook-%d", i+1)
+		}
+		if cfg.URL == "" {
+			log.Printf("Warning: Webhook %s: url is required, skipping", cfg.Name)
+			continue
+		}
+		target := newWebhookTarget(cfg)
+		webhookTargets = append(webhookTargets, target)
+		go target.run()
+	}
+
+	if len(webhookTargets) == 0 {
+		return
+	}
+	log.Printf("Sending events to %d webhook target(s)", len(webhookTargets))
+
+	subscribeEvents(func(event PortEvent) {
+		for _, target := range webhookTargets {
+			if target.wants(event) {
+				target.enqueue(event, "")
+			}
+		}
+	})
+}
+
+// wants reports whether an event passes the target's filters
+func (t *webhookTarget) wants(event PortEvent) bool {
+	if len(t.cfg.Events) > 0 && !eventTypeMatches(t.cfg.Events, event.Type) {
+		return false
+	}
+	return t.cfg.Match.matches(event)
+}
+
+// findWebhookTarget returns the target with the given name, or nil
+func findWebhookTarget(name string) *webhookTarget {
+	for _, t := range webhookTargets {
+		if t.cfg.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// enqueue records a delivery of an event, sent by a rule if rule is set, and
+// queues it; when the target is backed up the delivery is dropped rather than
+// blocking the publisher
+func (t *webhookTarget) enqueue(event PortEvent, rule string) *WebhookDelivery {
+	delivery := &WebhookDelivery{
+		ID:        fmt.Sprintf("%d-%d", time.Now().Unix(), atomic.AddUint64(&webhookSeq, 1)),
+		Target:    t.cfg.Name,
+		EventType: event.Type,
+		PortID:    event.PortID,
+		Queued:    time.Now(),
+		Status:    "pending",
+	}
+
+	body, err := json.Marshal(WebhookPayload{ID: delivery.ID, Target: t.cfg.Name, Rule: rule, Event: event})
+	if err != nil {
+		delivery.Status = "failed"
+		delivery.Error = err.Error()
+	}
+	recordWebhookDelivery(delivery)
+	if err != nil {
+		return delivery
+	}
+
+	select {
+	case t.queue <- webhookJob{delivery: delivery, body: body, delay: t.backoff}:
+	default:
+		t.finish(delivery, "dropped", "delivery queue full")
+		log.Printf("Warning: Webhook %s: queue full, dropping %s event on %s", t.cfg.Name, event.Type, event.PortID)
+	}
+	return delivery
+}
+
+// run delivers queued events in order, one at a time
+func (t *webhookTarget) run() {
+	for job := range t.queue {
+		t.attempt(job)
+	}
+}
+
+// attempt posts a delivery once. Retries are scheduled on a timer with exponential
+// back-off rather than waited for, so a failing endpoint does not hold up the
+// deliveries queued behind it.
+func (t *webhookTarget) attempt(job webhookJob) {
+	delivery := job.delivery
+	job.attempts++
+	statusCode, err := t.post(delivery, job.body)
+
+	webhookDeliveries.Lock()
+	delivery.Attempts = job.attempts
+	delivery.StatusCode = statusCode
+	delivery.Error = ""
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+	webhookDeliveries.Unlock()
+
+	switch {
+	case err == nil:
+		t.finish(delivery, "delivered", "")
+	case !retryableWebhookStatus(statusCode) || job.attempts > t.maxRetries:
+		t.finish(delivery, "failed", err.Error())
+		log.Printf("Webhook %s: giving up on %s after %d attempt(s): %v", t.cfg.Name, delivery.ID, job.attempts, err)
+	default:
+		delay := job.delay
+		if job.delay *= 2; job.delay > maxWebhookBackoff {
+			job.delay = maxWebhookBackoff
+		}
+		time.AfterFunc(delay, func() { t.attempt(job) })
+	}
+}
+
+// retryableWebhookStatus reports whether a failed attempt is worth retrying: network
+// errors (no status), server errors and rate limiting are; other client errors are not
+func retryableWebhookStatus(statusCode int) bool {
+	return statusCode == 0 || statusCode >= 500 || statusCode == http.StatusTooManyRequests
+}
+
+// post sends one attempt of a delivery
+func (t *webhookTarget) post(delivery *WebhookDelivery, body []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", t.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "hubcontrol")
+	req.Header.Set("X-Hubcontrol-Event", delivery.EventType)
+	req.Header.Set("X-Hubcontrol-Delivery", delivery.ID)
+	if t.cfg.Secret != "" {
+		req.Header.Set("X-Hubcontrol-Signature", "sha256="+signWebhook(t.cfg.Secret, body))
+	}
+	for name, value := range t.cfg.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// signWebhook returns the hex HMAC-SHA256 of a body, which receivers recompute
+// with the shared secret to verify the X-Hubcontrol-Signature header
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// finish marks a delivery as done and counts it
+func (t *webhookTarget) finish(delivery *WebhookDelivery, status, errMsg string) {
+	now := time.Now()
+	webhookDeliveries.Lock()
+	delivery.Status = status
+	delivery.Finished = &now
+	if errMsg != "" {
+		delivery.Error = errMsg
+	}
+	webhookDeliveries.Unlock()
+	webhookResults.inc(t.cfg.Name, status)
+}
+
+// recordWebhookDelivery adds a delivery to the log, dropping the oldest entries
+func recordWebhookDelivery(delivery *WebhookDelivery) {
+	webhookDeliveries.Lock()
+	defer webhookDeliveries.Unlock()
+	webhookDeliveries.list = append(webhookDeliveries.list, delivery)
+	if len(webhookDeliveries.list) > maxWebhookDeliveries {
+		webhookDeliveries.list = webhookDeliveries.list[len(webhookDeliveries.list)-maxWebhookDeliveries:]
+	}
+}
+
+// getWebhooks returns the configured targets, without secrets
+func getWebhooks(w http.ResponseWriter, r *http.Request) {
+	targets := make([]WebhookConfig, 0, len(webhookTargets))
+	for _, t := range webhookTargets {
+		targets = append(targets, t.cfg)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(targets)
+}
+
+// getWebhookDeliveries returns recent deliveries, newest first, optionally
+// filtered by target and status
+func getWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	targetFilter := r.URL.Query().Get("target")
+	statusFilter := r.URL.Query().Get("status")
+	limit := maxWebhookDeliveries
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	webhookDeliveries.Lock()
+	deliveries := make([]WebhookDelivery, 0)
+	for i := len(webhookDeliveries.list) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		d := webhookDeliveries.list[i]
+		if (targetFilter == "" || d.Target == targetFilter) && (statusFilter == "" || d.Status == statusFilter) {
+			deliveries = append(deliveries, *d)
+		}
+	}
+	webhookDeliveries.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// testWebhook queues a "test" event for a target, ignoring its filters
+func testWebhook(w http.ResponseWriter, r *http.Request) {
+	t := findWebhookTarget(mux.Vars(r)["name"])
+	if t == nil {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	delivery := t.enqueue(PortEvent{
+		Time:    time.Now(),
+		Type:    "test",
+		Source:  "api",
+		Message: "test delivery",
+	}, "")
+
+	webhookDeliveries.Lock()
+	result := *delivery
+	webhookDeliveries.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(result)
+}
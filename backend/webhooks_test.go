@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver is a test endpoint that answers with a fixed sequence of statuses,
+// then 200, and keeps the requests it got
+type webhookReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (rcv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	rcv.requests = append(rcv.requests, r)
+	rcv.bodies = append(rcv.bodies, body)
+	status := http.StatusOK
+	if len(rcv.statuses) > 0 {
+		status, rcv.statuses = rcv.statuses[0], rcv.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+// waitWebhookDelivery waits until a delivery is no longer pending and returns a copy
+func waitWebhookDelivery(t *testing.T, delivery *WebhookDelivery) WebhookDelivery {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		webhookDeliveries.Lock()
+		d := *delivery
+		webhookDeliveries.Unlock()
+		if d.Status != "pending" {
+			return d
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("delivery %s still pending after %d attempt(s)", d.ID, d.Attempts)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	rcv := &webhookReceiver{}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	target := newWebhookTarget(WebhookConfig{Name: "signed", URL: server.URL, Secret: "s3cret"})
+	go target.run()
+	delivery := waitWebhookDelivery(t, target.enqueue(PortEvent{Type: EventAttach, PortID: "1-3.1.2"}, ""))
+	if delivery.Status != "delivered" {
+		t.Fatalf("status %s, want delivered", delivery.Status)
+	}
+
+	req, body := rcv.requests[0], rcv.bodies[0]
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(body)
+	if got, want := req.Header.Get("X-Hubcontrol-Signature"), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+		t.Errorf("signature %q, want %q", got, want)
+	}
+	if got := req.Header.Get("X-Hubcontrol-Event"); got != EventAttach {
+		t.Errorf("event header %q, want %q", got, EventAttach)
+	}
+	var payload WebhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.ID != delivery.ID || payload.Target != "signed" || payload.Event.PortID != "1-3.1.2" {
+		t.Errorf("unexpected payload %+v", payload)
+	}
+}
+
+func TestWebhookFilters(t *testing.T) {
+	target := newWebhookTarget(WebhookConfig{
+		Name:   "filtered",
+		URL:    "http://localhost/",
+		Events: []string{EventAttach, "power"},
+		Match:  RuleMatch{Hub: "Test Hub", VendorID: "0403"},
+	})
+	tests := []struct {
+		event PortEvent
+		want  bool
+	}{
+		{PortEvent{Type: EventAttach, HubName: "Test Hub", VendorID: "0403"}, true},
+		{PortEvent{Type: EventPowerCycle, HubName: "test hub", VendorID: "0403"}, true},
+		{PortEvent{Type: EventDetach, HubName: "Test Hub", VendorID: "0403"}, false},
+		{PortEvent{Type: EventAttach, HubName: "Other Hub", VendorID: "0403"}, false},
+		{PortEvent{Type: EventAttach, HubName: "Test Hub", VendorID: "046d"}, false},
+	}
+	for _, tt := range tests {
+		if got := target.wants(tt.event); got != tt.want {
+			t.Errorf("%s on %s (%s): wants = %v, want %v", tt.event.Type, tt.event.HubName, tt.event.VendorID, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	intPtr := func(n int) *int { return &n }
+	tests := []struct {
+		name       string
+		statuses   []int
+		maxRetries *int
+		status     string
+		attempts   int
+	}{
+		{"server errors retried", []int{503, 500}, nil, "delivered", 3},
+		{"rate limit retried", []int{429}, nil, "delivered", 2},
+		{"client error not retried", []int{400}, nil, "failed", 1},
+		{"gives up after max retries", []int{502, 502, 502}, intPtr(2), "failed", 3},
+		{"zero max retries", []int{503}, intPtr(0), "failed", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rcv := &webhookReceiver{statuses: tt.statuses}
+			server := httptest.NewServer(rcv)
+			defer server.Close()
+
+			target := newWebhookTarget(WebhookConfig{Name: tt.name, URL: server.URL, MaxRetries: tt.maxRetries, Backoff: "1ms"})
+			go target.run()
+			delivery := waitWebhookDelivery(t, target.enqueue(PortEvent{Type: EventDetach}, ""))
+			if delivery.Status != tt.status || delivery.Attempts != tt.attempts {
+				t.Errorf("%s after %d attempt(s), want %s after %d", delivery.Status, delivery.Attempts, tt.status, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestWebhookRetryDoesNotBlockQueue(t *testing.T) {
+	rcv := &webhookReceiver{statuses: []int{503}}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	// The first delivery waits a minute for its retry; the second must not wait for it
+	target := newWebhookTarget(WebhookConfig{Name: "slow-retry", URL: server.URL, Backoff: "1m"})
+	go target.run()
+	first := target.enqueue(PortEvent{Type: EventAttach}, "")
+	second := waitWebhookDelivery(t, target.enqueue(PortEvent{Type: EventDetach}, ""))
+	if second.Status != "delivered" {
+		t.Errorf("second delivery %s, want delivered", second.Status)
+	}
+
+	webhookDeliveries.Lock()
+	defer webhookDeliveries.Unlock()
+	if first.Status != "pending" || first.Attempts != 1 {
+		t.Errorf("first delivery %s after %d attempt(s), want pending after 1", first.Status, first.Attempts)
+	}
+}
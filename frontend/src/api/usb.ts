@@ -1,10 +1,39 @@
 import type { USBTopology, PowerControlRequest, PowerControlResponse } from '../types/usb';
 
 const API_BASE = '/api';
+const TOKEN_KEY = 'hubcontrolToken';
+
+// API token, taken from ?token= on first visit and kept in local storage
+function apiToken(): string | null {
+  const params = new URLSearchParams(window.location.search);
+  const token = params.get('token');
+  if (token) {
+    localStorage.setItem(TOKEN_KEY, token);
+    params.delete('token');
+    const query = params.toString();
+    window.history.replaceState(null, '', window.location.pathname + (query ? `?${query}` : ''));
+  }
+  return localStorage.getItem(TOKEN_KEY);
+}
+
+function authHeaders(): Record<string, string> {
+  const token = apiToken();
+  return token ? { Authorization: `Bearer ${token}` } : {};
+}
+
+function checkAuth(response: Response) {
+  if (response.status === 401) {
+    throw new Error('Not authorized: open this page with ?token=<your API token>');
+  }
+  if (response.status === 403) {
+    throw new Error('Your API token is not allowed to do this');
+  }
+}
 
 export async function fetchTopology(aggregate: boolean = false): Promise<USBTopology> {
   const url = aggregate ? `${API_BASE}/topology?aggregate=true` : `${API_BASE}/topology`;
-  const response = await fetch(url);
+  const response = await fetch(url, { headers: authHeaders() });
+  checkAuth(response);
   if (!response.ok) {
     throw new Error('Failed to fetch USB topology');
   }
@@ -16,9 +45,11 @@ export async function controlPower(request: PowerControlRequest): Promise<PowerC
     method: 'POST',
     headers: {
       'Content-Type': 'application/json',
+      ...authHeaders(),
     },
     body: JSON.stringify(request),
   });
+  checkAuth(response);
   if (!response.ok) {
     throw new Error('Failed to control power');
   }
@@ -26,7 +57,8 @@ export async function controlPower(request: PowerControlRequest): Promise<PowerC
 }
 
 export async function fetchUhubctlInfo(): Promise<{ available: boolean; output: string }> {
-  const response = await fetch(`${API_BASE}/uhubctl`);
+  const response = await fetch(`${API_BASE}/uhubctl`, { headers: authHeaders() });
+  checkAuth(response);
   if (!response.ok) {
     throw new Error('Failed to fetch uhubctl info');
   }
@@ -15,6 +15,7 @@ export function PowerControl({ device, port, onClose, onActionComplete }: PowerC
   const [result, setResult] = useState<{ success: boolean; message: string } | null>(null);
 
   const displayNumber = port.mappedPort || port.port;
+  const allowed = port.canControl !== false;
   
   // For uhubctl, we need the location (USB path) and the port number on that hub
   // Format: <bus>-<path> e.g., "10-1.3" for bus 10, path 1.3
@@ -104,6 +105,17 @@ export function PowerControl({ device, port, onClose, onActionComplete }: PowerC
               <span className="info-value">{port.device.name}</span>
             </div>
           )}
+          {port.owners && port.owners.length > 0 && (
+            <div className="info-row">
+              <span className="info-label">Owners:</span>
+              <span className="info-value">{port.owners.join(', ')}</span>
+            </div>
+          )}
+          {!allowed && (
+            <div className="info-row">
+              <span className="info-value">You are not allowed to control this port</span>
+            </div>
+          )}
           <div className="info-row command-preview">
             <span className="info-label">Command:</span>
             <span className="info-value">{uhubctlCommand}</span>
@@ -114,21 +126,21 @@ export function PowerControl({ device, port, onClose, onActionComplete }: PowerC
           <button 
             className="power-btn power-on"
             onClick={() => handleAction('on')}
-            disabled={loading}
+            disabled={loading || !allowed}
           >
             Power ON
           </button>
           <button 
             className="power-btn power-off"
             onClick={() => handleAction('off')}
-            disabled={loading}
+            disabled={loading || !allowed}
           >
             Power OFF
           </button>
           <button 
             className="power-btn power-cycle"
             onClick={() => handleAction('cycle')}
-            disabled={loading}
+            disabled={loading || !allowed}
           >
             Cycle
           </button>
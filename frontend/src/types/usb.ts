@@ -9,15 +9,43 @@ export interface USBDevice {
   class: string;
   driver: string;
   speed: string;
+  serial?: string;
+  manufacturer?: string; // String descriptors reported by the device
+  product?: string;
   ports?: USBPort[];
+  // Power
+  maxPowerMa?: number;
+  selfPowered?: boolean;
+  powerBudget?: PowerBudget;
+  // Link diagnostics
+  usbVersion?: string;  // bcdUSB, e.g. "3.20"
+  depth?: number;       // Tiers below the root hub
+  issues?: LinkIssue[];
   // Aggregation fields
   aggregated?: boolean;
+  hubName?: string;     // Name to address the hub by, e.g. with hubctl
+  model?: string;       // lsusb name of the hub
   totalPorts?: number;
   subHubCount?: number;
   physicalPorts?: USBPort[];
   gridLayout?: number[][]; // 2D layout for visual display, -1 = spacer
 }
 
+export interface PowerBudget {
+  selfPowered: boolean;
+  availableMa: number;  // Current the hub can supply downstream
+  usedMa: number;       // Sum of bMaxPower of attached devices
+  portLimitMa: number;  // Default current limit per port
+  exceeded: boolean;
+  warnings?: string[];
+}
+
+export interface LinkIssue {
+  kind: 'degraded_speed' | 'full_speed_bottleneck' | 'tier_depth';
+  severity: 'info' | 'warning' | 'error';
+  message: string;
+}
+
 export interface USBPort {
   port: number;
   device?: USBDevice;
@@ -27,6 +55,37 @@ export interface USBPort {
   location?: string;
   mappedPort?: number;  // Physical port number from config mapping
   portKey?: string;     // Key used for port mapping (e.g., "1.3")
+  errors?: PortErrorCounters; // Kernel-reported errors on this port
+  activity?: PortActivity;    // Uptime and reconnect counters
+  canControl?: boolean;       // Whether the caller may switch this port
+  owners?: string[];          // Token names or roles owning this port
+  lease?: PortLease;          // Active reservation of the port
+  powered?: boolean;          // Power state, if switched since the server started
+}
+
+export interface PortLease {
+  id?: string; // Only in the response to acquiring the lease
+  portIds: string[];
+  owner: string;
+  reason?: string;
+  acquired: string;
+  expires: string;
+}
+
+export interface PortActivity {
+  attachedSince?: string;
+  uptimeSeconds?: number;
+  reconnectsLastHour: number;
+  reconnectsLastDay: number;
+  lastDetach?: string;
+  flapping?: boolean;
+}
+
+export interface PortErrorCounters {
+  overCurrent: number;
+  enumErrors: number;
+  lastError: string;
+  lastMessage: string;
 }
 
 export interface USBBus {